@@ -0,0 +1,82 @@
+// Package checksum provides the hash algorithms of the GridFTP CKSM and
+// the HASH command (draft-bryan-ftp-hash), which verify transfers end to end.
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Supported algorithms, named as in the HASH draft
+const (
+	SHA256  = "SHA-256"
+	SHA1    = "SHA-1"
+	SHA512  = "SHA-512"
+	MD5     = "MD5"
+	CRC32C  = "CRC32C"
+	Adler32 = "ADLER32"
+)
+
+// Algorithms lists the supported algorithms, the first one is the default
+var Algorithms = []string{SHA256, SHA1, SHA512, MD5, CRC32C, Adler32}
+
+var constructors = map[string]func() hash.Hash{
+	SHA256:  sha256.New,
+	SHA1:    sha1.New,
+	SHA512:  sha512.New,
+	MD5:     md5.New,
+	CRC32C:  func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	Adler32: func() hash.Hash { return adler32.New() },
+}
+
+// Name returns the name of the algorithm as listed in Algorithms. Names
+// are case-insensitive and may omit the dash, GridFTP clients send SHA1
+func Name(algorithm string) (string, error) {
+	normalized := strings.ToUpper(strings.Replace(algorithm, "-", "", -1))
+	for _, name := range Algorithms {
+		if strings.Replace(name, "-", "", -1) == normalized {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported algorithm %s", algorithm)
+}
+
+// New returns a hash of the algorithm
+func New(algorithm string) (hash.Hash, error) {
+	name, err := Name(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return constructors[name](), nil
+}
+
+// Sum returns the hash of the data read from r, hex encoded
+func Sum(algorithm string, r io.Reader) (string, error) {
+	h, err := New(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return Hex(h), nil
+}
+
+// Hex returns the hash computed so far, hex encoded
+func Hex(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,34 @@
+package checksum
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"SHA-256", "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{"sha1", "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"},
+		{"MD5", "5eb63bbbe01eeed093cb22bb8f5acdc3"},
+		{"crc32c", "c99465aa"},
+		{"ADLER32", "1a0b045d"},
+	}
+
+	for _, test := range tests {
+		sum, err := Sum(test.algorithm, strings.NewReader("hello world"))
+		if err != nil {
+			t.Errorf("%s: %s", test.algorithm, err)
+			continue
+		}
+		if sum != test.expected {
+			t.Errorf("%s: got %s, want %s", test.algorithm, sum, test.expected)
+		}
+	}
+
+	if _, err := Sum("SHA-3", strings.NewReader("hello world")); err == nil {
+		t.Errorf("expected an unsupported algorithm")
+	}
+}
@@ -0,0 +1,147 @@
+package ftp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
+)
+
+// activeConns are the data connections of a transfer that the server opens
+// to the client. Servers connect either while handling EPRT or SPOR, or only
+// after the transfer command, hence they are accepted in the background
+type activeConns struct {
+	server    *ServerConn
+	listeners []scion.Listener
+	result    chan acceptedConns
+}
+
+type acceptedConns struct {
+	conns []scion.Conn
+	err   error
+}
+
+// listenActive listens for the data connections of a transfer and issues
+// an EPRT command, or an SPOR command for striped transfers, so that the
+// server connects to them
+func (server *ServerConn) listenActive() (*activeConns, error) {
+	n := 1
+	if server.extendedMode && server.options.parallelism > 1 {
+		n = server.options.parallelism
+	}
+
+	active, ports, err := server.listenDataConns(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.extendedMode {
+		stripes := make([]string, len(ports))
+		for i, port := range ports {
+			stripes[i] = transport.JoinStripe(server.local, port)
+		}
+
+		_, _, err = server.cmd(StatusCommandOK, "SPOR %s", strings.Join(stripes, " "))
+	} else {
+		_, _, err = server.cmd(StatusCommandOK, "EPRT %s", eprtParam(server.local, ports[0]))
+	}
+	if err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	return active, nil
+}
+
+// listenDataConns opens n ports on the local host and starts accepting
+// a connection on each of them
+func (server *ServerConn) listenDataConns(n int) (*activeConns, []int, error) {
+	active := &activeConns{
+		server: server,
+		result: make(chan acceptedConns, 1),
+	}
+
+	var ports []int
+	for i := 0; i < n; i++ {
+		listener, err := server.dataTransport.Listen(transport.JoinHostPort(server.local, 0))
+		if err != nil {
+			active.closeListeners()
+			return nil, nil, err
+		}
+		active.listeners = append(active.listeners, listener)
+
+		_, port, err := transport.SplitHostPort(listener.Addr().String())
+		if err != nil {
+			active.closeListeners()
+			return nil, nil, err
+		}
+		ports = append(ports, port)
+	}
+
+	go func(listeners []scion.Listener) {
+		var conns []scion.Conn
+		for _, listener := range listeners {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				active.result <- acceptedConns{err: err}
+				return
+			}
+			conns = append(conns, conn)
+		}
+		active.result <- acceptedConns{conns: conns}
+	}(active.listeners)
+
+	return active, ports, nil
+}
+
+// accept waits until the server connected to all ports, at most for the
+// timeout set by DialWithAcceptTimeout, and returns the data socket
+func (active *activeConns) accept() (socket.DataSocket, error) {
+	server := active.server
+	timeout := server.options.acceptTimeout
+
+	timer := time.AfterFunc(timeout, active.closeListeners)
+	r := <-active.result
+	expired := !timer.Stop()
+	active.closeListeners()
+
+	if r.err != nil {
+		if expired {
+			return nil, fmt.Errorf("server did not connect within %s", timeout)
+		}
+		return nil, r.err
+	}
+
+	socks := make([]socket.DataSocket, len(r.conns))
+	for i := range r.conns {
+		socks[i] = socket.NewScionSocket(server.protect(r.conns[i]), i)
+	}
+
+	if !server.extendedMode {
+		return socks[0], nil
+	}
+
+	return server.newStripedSocket(socks), nil
+}
+
+// Close stops accepting and closes the connections accepted so far
+func (active *activeConns) Close() {
+	active.closeListeners()
+	if r := <-active.result; r.err == nil {
+		for _, c := range r.conns {
+			c.Close()
+		}
+	}
+}
+
+func (active *activeConns) closeListeners() {
+	for _, listener := range active.listeners {
+		listener.Close()
+	}
+}
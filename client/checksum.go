@@ -0,0 +1,154 @@
+package ftp
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elwin/transmit/checksum"
+)
+
+// Checksum returns the hex encoded hash of the remote file, computed with
+// one of checksum.Algorithms. It issues the GridFTP CKSM command, or the
+// HASH command if the server only supports the latter
+func (server *ServerConn) Checksum(path, algorithm string) (string, error) {
+	if _, ok := server.features["CKSM"]; !ok {
+		if _, ok := server.features["HASH"]; ok {
+			return server.hash(path, algorithm)
+		}
+	}
+
+	return server.checksumFrom(path, algorithm, 0)
+}
+
+// checksumFrom issues a CKSM FTP command, which returns the hash
+// of the remote file, starting at offset
+func (server *ServerConn) checksumFrom(path, algorithm string, offset uint64) (string, error) {
+	_, msg, err := server.cmd(StatusFile, "CKSM %s %d -1 %s", algorithm, offset, path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(strings.TrimSpace(msg)), nil
+}
+
+// hash issues an "OPTS HASH" command to select the algorithm, followed
+// by a HASH FTP command. The reply is <algorithm> <range> <hash> <path>
+func (server *ServerConn) hash(path, algorithm string) (string, error) {
+	_, _, err := server.cmd(StatusCommandOK, "OPTS HASH %s", algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	_, msg, err := server.cmd(StatusFile, "HASH %s", path)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.SplitN(msg, " ", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("invalid HASH response %s", msg)
+	}
+
+	return strings.ToLower(fields[2]), nil
+}
+
+// verify compares the hash of the data transferred with the hash of the
+// remote file from offset on, if DialWithVerify is set
+func (server *ServerConn) verify(path string, offset uint64, local string) error {
+	remote, err := server.checksumFrom(path, server.options.verify, offset)
+	if err != nil {
+		return err
+	}
+
+	if remote != local {
+		return fmt.Errorf("checksum mismatch for %s: local %s, remote %s", path, local, remote)
+	}
+
+	return nil
+}
+
+// verifyFile compares the hash of file with the hash of the remote file
+func (server *ServerConn) verifyFile(path string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	local, err := checksum.Sum(server.options.verify, io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+
+	return server.verify(path, 0, local)
+}
+
+// verifyingStor returns the reader to send instead of r and a function that
+// verifies the data sent. The streams of striped transfers read files in
+// parallel, so these are hashed once the transfer is done rather than while
+// sending. Other readers are hashed while sending
+func (server *ServerConn) verifyingStor(path string, r io.Reader, offset uint64) (io.Reader, func() error, error) {
+	h, err := checksum.New(server.options.verify)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if file, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		start, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		verify := func() error {
+			end, err := file.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(h, io.NewSectionReader(file, start, end-start))
+			if err != nil {
+				return err
+			}
+
+			return server.verify(path, offset, checksum.Hex(h))
+		}
+
+		return r, verify, nil
+	}
+
+	verify := func() error {
+		return server.verify(path, offset, checksum.Hex(h))
+	}
+
+	return io.TeeReader(r, h), verify, nil
+}
+
+// verifyingReader hashes the data read, which Close compares
+// with the remote file once all of it has been read
+type verifyingReader struct {
+	path     string
+	offset   uint64
+	hash     hash.Hash
+	complete bool
+}
+
+func newVerifyingReader(algorithm, path string, offset uint64) (*verifyingReader, error) {
+	h, err := checksum.New(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifyingReader{path: path, offset: offset, hash: h}, nil
+}
+
+func (v *verifyingReader) read(p []byte, err error) {
+	v.hash.Write(p)
+	if err == io.EOF {
+		v.complete = true
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"github.com/elwin/transmit/mode"
 
 	"github.com/elwin/transmit/client"
+	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
 	"github.com/scionproto/scion/go/lib/log"
 )
 
@@ -19,6 +22,16 @@ func main() {
 	var (
 		local  = flag.String("local", "", "Local address (Format: AS,[IP])")
 		remote = flag.String("remote", "", "Remote address to connect to (Format: AS,[IP]:Port)")
+		tr     = flag.String("transport", "scion", "Transport (scion or tcp)")
+
+		interactive = flag.Bool("interactive", false, "Interactively choose the path of the control connection")
+		avoid       = flag.String("avoid", "", "Never route through these ASes (Format: ISD-AS,ISD-AS,...)")
+		minMTU      = flag.Uint("mtu", 0, "Prefer data paths with at least this MTU")
+		parallelism = flag.Int("parallelism", 0, "Number of parallel streams (Default: chosen by the server)")
+		redundant   = flag.Bool("redundant", false, "Also send segments of the slowest stream over the fastest one")
+		checksums   = flag.Bool("checksums", false, "Verify each segment with a checksum")
+		active      = flag.Bool("active", false, "Let the server connect to the client for data transfers")
+		verify      = flag.String("verify", "", "Verify transferred files with this hash algorithm, e.g. SHA-256")
 	)
 
 	flag.Parse()
@@ -29,11 +42,39 @@ func main() {
 		l.Fatalf("Please set a remote address with -remote")
 	}
 
+	t, err := transport.Lookup(*tr)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	avoided, err := scion.ParseIAs(*avoid)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	var policy scion.PathPolicy
+	if len(avoided) > 0 {
+		policy = scion.AvoidIA(avoided...)
+	}
+
+	dataPolicy := scion.Chain(policy, scion.PreferMTU(uint16(*minMTU)))
+	if *interactive {
+		policy = scion.Chain(policy, scion.Interactive(os.Stdin, os.Stdout))
+	}
+
 	conn, err := ftp.Dial(
 		*local,
 		*remote,
 		// ftp.DialWithDebugOutput(os.Stdout),
 		ftp.DialWithTimeout(60*time.Second),
+		ftp.DialWithTransport(t),
+		ftp.DialWithPathPolicy(policy),
+		ftp.DialWithDataPathPolicy(dataPolicy),
+		ftp.DialWithParallelism(*parallelism),
+		ftp.DialWithScheduler(&socket.Weighted{Redundant: *redundant}),
+		ftp.DialWithChecksums(*checksums),
+		ftp.DialWithVerify(*verify),
+		ftp.DialWithActiveMode(*active),
 	)
 	if err != nil {
 		log.Error("Failed to dial", "err", err)
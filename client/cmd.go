@@ -6,14 +6,16 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
 
 	"github.com/elwin/transmit/scion"
-	"github.com/scionproto/scion/go/lib/snet"
 )
 
 // Login authenticates the client with specified user and password.
@@ -45,13 +47,27 @@ func (server *ServerConn) Login(user, password string) error {
 	// Switch to UTF-8
 	err = server.setUTF8()
 
-	// If using implicit TLS, make data connections also use TLS
+	if err != nil {
+		return err
+	}
+
+	// If using TLS, make data connections also use TLS
 	if server.options.tlsConfig != nil {
-		server.cmd(StatusCommandOK, "PBSZ 0")
-		server.cmd(StatusCommandOK, "PROT P")
+		if _, _, err = server.cmd(StatusCommandOK, "PBSZ 0"); err != nil {
+			return err
+		}
+
+		level := "P"
+		if server.options.clearData {
+			level = "C"
+		}
+		if _, _, err = server.cmd(StatusCommandOK, "PROT "+level); err != nil {
+			return err
+		}
+		server.protected = !server.options.clearData
 	}
 
-	return err
+	return nil
 }
 
 // feat issues a FEAT FTP command to list the additional commands supported by
@@ -91,6 +107,17 @@ func (server *ServerConn) feat() error {
 	return nil
 }
 
+// SetParallelism issues an "OPTS RETR Parallelism=n,n,n;" command, which
+// sets the number of streams of subsequent striped transfers.
+func (server *ServerConn) SetParallelism(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid parallelism %d", n)
+	}
+
+	_, _, err := server.cmd(StatusCommandOK, "OPTS RETR Parallelism=%d,%d,%d;", n, n, n)
+	return err
+}
+
 // setUTF8 issues an "OPTS UTF8 ON" command.
 func (server *ServerConn) setUTF8() error {
 	if _, ok := server.features["UTF8"]; !ok {
@@ -193,7 +220,7 @@ func (server *ServerConn) pasv() (port int, err error) {
 
 // getDataConn returns a host, port for a new data connection
 // it uses the best available method to do so
-func (server *ServerConn) getDataConn() (*snet.Addr, error) {
+func (server *ServerConn) getDataConn() (string, error) {
 
 	/*
 		if !server.options.disableEPSV && !server.skipEPSV {
@@ -213,16 +240,14 @@ func (server *ServerConn) getDataConn() (*snet.Addr, error) {
 
 	port, err := server.pasv()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	host := scion.AddrToString(server.remote)
-	addr, err := snet.AddrFromString(host + ":" + strconv.Itoa(port))
-	return addr, err
+	return transport.JoinHostPort(server.remote, port), nil
 
 }
 
-func (server *ServerConn) getDataConns() ([]snet.Addr, error) {
+func (server *ServerConn) getDataConns() ([]string, error) {
 
 	return server.spas()
 
@@ -236,23 +261,90 @@ func (server *ServerConn) openDataConn() (socket.DataSocket, error) {
 		return nil, err
 	}
 
-	conn, err := scion.Dial(server.local, *addr)
+	conn, err := server.dataTransport.Dial(server.local, addr)
+	if err != nil {
+		return nil, err
+	}
 
-	return socket.NewScionSocket(conn, 0), err
+	return socket.NewScionSocket(server.protect(conn), 0), nil
 }
 
-func (server *ServerConn) openDataConns() ([]scion.Conn, error) {
+// openStripedSocket creates the FTP data connections of a striped transfer
+func (server *ServerConn) openStripedSocket() (*socket.MultiSocket, error) {
 
 	addrs, err := server.getDataConns()
 	if err != nil {
 		return nil, err
 	}
 
+	conns, err := server.openDataConns(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	socks := make([]socket.DataSocket, len(conns))
+	for i := range conns {
+		socks[i] = socket.NewScionSocket(server.protect(conns[i]), i)
+	}
+
+	sock := server.newStripedSocket(socks)
+
+	// The server keeps accepting connections on the striped
+	// passive ports during the transfer. A new connection
+	// queries the paths again, which no longer contain paths
+	// over failed links once they have been revoked. Until
+	// then, replacements rotate through the available paths
+	// rather than dialing the preferred one, which is likely
+	// the path that just failed
+	if server.options.redial {
+		var mu sync.Mutex
+		dialed := len(addrs)
+		sock.SetRedial(func() (socket.DataSocket, error) {
+			mu.Lock()
+			n := dialed
+			dialed++
+			mu.Unlock()
+
+			conn, err := server.dialReplacement(addrs[n%len(addrs)], n)
+			if err != nil {
+				return nil, err
+			}
+
+			return socket.NewScionSocket(server.protect(conn), n), nil
+		})
+	}
+
+	return sock, nil
+}
+
+// newStripedSocket sends and receives in extended block
+// mode over the sockets, configured by the dial options
+func (server *ServerConn) newStripedSocket(socks []socket.DataSocket) *socket.MultiSocket {
+	sock := socket.NewMultiSocket(socks, server.options.adaptive.MaxChunkLength)
+	sock.SetAdaptive(server.options.adaptive)
+	sock.SetScheduler(server.options.scheduler)
+	sock.SetBufferSize(server.options.receiveBuffer)
+	sock.SetAcknowledge(server.acknowledge)
+	sock.SetChecksums(server.options.checksums)
+
+	return sock
+}
+
+func (server *ServerConn) openDataConns(addrs []string) ([]scion.Conn, error) {
+
+	// Striped connections should not compete for the same path
+	if multipath, ok := server.dataTransport.(transport.Multipath); ok {
+		return multipath.DialMultipath(server.local, addrs)
+	}
+
 	var conns []scion.Conn
 
 	for _, addr := range addrs {
-		conn, err := scion.Dial(server.local, addr)
+		conn, err := server.dataTransport.Dial(server.local, addr)
 		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
 			return nil, err
 		}
 
@@ -262,6 +354,16 @@ func (server *ServerConn) openDataConns() ([]scion.Conn, error) {
 	return conns, nil
 }
 
+// dialReplacement opens the n-th data connection of a striped transfer
+// to replace a failed one, over another path if the transport allows
+func (server *ServerConn) dialReplacement(addr string, n int) (scion.Conn, error) {
+	if multipath, ok := server.dataTransport.(transport.Multipath); ok {
+		return multipath.DialReplacement(server.local, addr, n)
+	}
+
+	return server.dataTransport.Dial(server.local, addr)
+}
+
 // cmd is a helper function to execute a command and check for the expected FTP
 // return code
 func (server *ServerConn) cmd(expected int, format string, args ...interface{}) (code int, message string, err error) {
@@ -287,24 +389,32 @@ func (server *ServerConn) dispatchCmd(format string, args ...interface{}) error
 // cmdDataConnFrom executes a command which require a FTP data connection.
 // Issues a REST FTP command to specify the number of bytes to skip for the transfer.
 func (server *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (socket.DataSocket, error) {
+	var rest string
+	if offset != 0 {
+		rest = strconv.FormatUint(offset, 10)
+	}
+
+	return server.cmdDataConnRest(rest, format, args...)
+}
+
+// cmdDataConnRest executes a command which require a FTP data connection,
+// preceded by a REST FTP command with the given restart marker, if any.
+func (server *ServerConn) cmdDataConnRest(rest string, format string, args ...interface{}) (socket.DataSocket, error) {
+
+	if server.options.active {
+		return server.cmdActiveDataConn(rest, format, args...)
+	}
 
 	var sock socket.DataSocket
 	var err error
 
 	if server.extendedMode {
 
-		conns, err := server.openDataConns()
+		sock, err = server.openStripedSocket()
 		if err != nil {
 			return nil, err
 		}
 
-		socks := make([]socket.DataSocket, len(conns))
-		for i := range conns {
-			socks[i] = socket.NewScionSocket(conns[i], i)
-		}
-
-		sock = socket.NewMultiSocket(socks, server.maxChunkSize)
-
 	} else {
 
 		sock, err = server.openDataConn()
@@ -313,33 +423,79 @@ func (server *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...
 		}
 	}
 
-	if offset != 0 {
-		_, _, err := server.cmd(StatusRequestFilePending, "REST %d", offset)
+	if rest != "" {
+		_, _, err := server.cmd(StatusRequestFilePending, "REST %s", rest)
 		if err != nil {
 			sock.Close()
 			return nil, err
 		}
 	}
 
-	err = server.dispatchCmd(format, args...)
+	err = server.startTransfer(format, args...)
 	if err != nil {
 		sock.Close()
 		return nil, err
 	}
 
-	code, msg, err := server.conn.ReadResponse(-1)
+	return sock, nil
+}
+
+// cmdActiveDataConn is cmdDataConnRest in active mode. The data connections
+// are only accepted once the transfer command has been sent, servers
+// might not connect before
+func (server *ServerConn) cmdActiveDataConn(rest string, format string, args ...interface{}) (socket.DataSocket, error) {
+	active, err := server.listenActive()
 	if err != nil {
-		sock.Close()
 		return nil, err
 	}
-	if code != StatusAlreadyOpen && code != StatusAboutToSend {
-		sock.Close()
-		return nil, &textproto.Error{Code: code, Msg: msg}
+
+	if rest != "" {
+		_, _, err := server.cmd(StatusRequestFilePending, "REST %s", rest)
+		if err != nil {
+			active.Close()
+			return nil, err
+		}
+	}
+
+	err = server.startTransfer(format, args...)
+	if err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	sock, err := active.accept()
+	if err != nil {
+		// The server fails the transfer without data connections
+		server.transferResponse()
+		return nil, err
 	}
 
 	return sock, nil
 }
 
+// startTransfer executes a command which transfers data over the
+// data connection that has been set up, and waits until it started
+func (server *ServerConn) startTransfer(format string, args ...interface{}) error {
+	err := server.dispatchCmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	code, msg, err := server.conn.ReadResponse(-1)
+	if err != nil {
+		return err
+	}
+	if code != StatusAlreadyOpen && code != StatusAboutToSend {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+
+	if server.extendedMode {
+		server.watchTransfer()
+	}
+
+	return nil
+}
+
 // NameList issues an NLST FTP command.
 func (server *ServerConn) NameList(path string) (entries []string, err error) {
 	conn, err := server.cmdDataConnFrom(0, "NLST %s", path)
@@ -348,7 +504,7 @@ func (server *ServerConn) NameList(path string) (entries []string, err error) {
 	}
 
 	r := &ConnResponse{conn: conn, c: server}
-	// defer r.Close()
+	defer r.Close()
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -379,7 +535,7 @@ func (server *ServerConn) List(path string) (entries []*Entry, err error) {
 	}
 
 	r := &ConnResponse{conn: conn, c: server}
-	// defer r.Close()
+	defer r.Close()
 
 	scanner := bufio.NewScanner(r)
 	now := time.Now()
@@ -454,8 +610,43 @@ func (server *ServerConn) RetrFrom(path string, offset uint64) (Response, error)
 		return nil, err
 	}
 
-	// TODO: Issues with closing our new channel
-	return &ConnResponse{conn: socket, c: server}, nil
+	response := &ConnResponse{conn: socket, c: server}
+	if server.options.verify != "" {
+		response.verify, err = newVerifyingReader(server.options.verify, path, offset)
+		if err != nil {
+			response.Close()
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// RetrToFile issues a RETR FTP command to fetch the specified file from the
+// remote FTP server and writes it to file. In extended block mode, each segment
+// is written at its offset as soon as it arrives, rather than in order.
+func (server *ServerConn) RetrToFile(path string, file *os.File) error {
+	conn, err := server.cmdDataConnFrom(0, "RETR %s", path)
+	if err != nil {
+		return err
+	}
+
+	if striped, ok := conn.(*socket.MultiSocket); ok {
+		_, err = striped.CopyTo(file)
+	} else {
+		_, err = io.Copy(file, conn)
+	}
+
+	response := &ConnResponse{conn: conn, c: server}
+	if closeErr := response.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && server.options.verify != "" {
+		err = server.verifyFile(path, file)
+	}
+
+	return err
 }
 
 // Stor issues a STOR FTP command to store a file to the remote FTP server.
@@ -468,26 +659,50 @@ func (server *ServerConn) Stor(path string, r io.Reader) error {
 
 // StorFrom issues a STOR FTP command to store a file to the remote FTP server.
 // Stor creates the specified file with the content of the io.Reader, writing
-// on the server will start at the given file offset.
+// on the server will start at the given file offset. In extended block mode,
+// the streams read an *os.File or another seekable io.ReaderAt in parallel.
 //
 // Hint: io.Pipe() can be used if an io.Writer is required.
 func (server *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
+	var verify func() error
+	if server.options.verify != "" {
+		var err error
+		r, verify, err = server.verifyingStor(path, r, offset)
+		if err != nil {
+			return err
+		}
+	}
+
 	conn, err := server.cmdDataConnFrom(offset, "STOR %s", path)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(conn, r)
+	// Striped sockets read files with positional reads on all streams,
+	// io.Copy would prefer the WriterTo of *os.File
+	if readerFrom, ok := conn.(io.ReaderFrom); ok {
+		_, err = readerFrom.ReadFrom(r)
+	} else {
+		_, err = io.Copy(conn, r)
+	}
 	if err != nil {
+		// The server still concludes the transfer
+		conn.Close()
+		server.transferResponse()
 		return err
 	}
 
 	err = conn.Close()
 	if err != nil {
+		server.transferResponse()
 		return fmt.Errorf("error closing the connection: %s", err)
 	}
 
-	_, _, err = server.conn.ReadResponse(StatusClosingDataConnection)
+	err = server.transferResponse()
+	if err == nil && verify != nil {
+		err = verify()
+	}
+
 	return err
 }
 
@@ -590,7 +805,7 @@ func (server *ServerConn) Quit() error {
 
 // Extensions
 
-func (server *ServerConn) spas() ([]snet.Addr, error) {
+func (server *ServerConn) spas() ([]string, error) {
 	_, line, err := server.cmd(StatusExtendedPassiveMode, "SPAS")
 	if err != nil {
 		return nil, err
@@ -598,45 +813,31 @@ func (server *ServerConn) spas() ([]snet.Addr, error) {
 
 	lines := strings.Split(line, "\n")
 
-	var addrs []snet.Addr
+	var addrs []string
 
 	for _, line = range lines {
 		if !strings.HasPrefix(line, " ") {
 			continue
 		}
 
-		addr, err := snet.AddrFromString(strings.TrimLeft(line, " "))
+		host, port, err := transport.SplitStripe(strings.TrimSpace(line))
 		if err != nil {
 			return nil, err
 		}
 
-		addrs = append(addrs, *addr)
+		addrs = append(addrs, transport.JoinHostPort(host, port))
 	}
 
 	return addrs, nil
 }
 
+// Eret issues an ERET FTP command to fetch length bytes of the specified
+// file, starting at offset.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
 func (server *ServerConn) Eret(path string, offset, length int) (Response, error) {
-
-	sockets, err := server.openDataConns()
-	socket := socket.NewScionSocket(sockets[0], 0)
-
-	if err != nil {
-		socket.Close()
-
-		return nil, err
-	}
-
-	_, line, err := server.cmd(
-		StatusAboutToSend,
-		"ERET PFT=\"%d,%d\" %s",
-		offset, length, path)
-
-	fmt.Println(line)
-
+	socket, err := server.cmdDataConnFrom(0, "ERET PFT=\"%d,%d\" %s", offset, length, path)
 	if err != nil {
-		socket.Close()
-
 		return nil, err
 	}
 
@@ -7,8 +7,11 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/elwin/transmit/checksum"
 	"github.com/elwin/transmit/scion"
-	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/striping"
+	"github.com/elwin/transmit/transport"
 	"io"
 	"net"
 	"net/textproto"
@@ -31,16 +34,24 @@ const (
 type ServerConn struct {
 	options *dialOptions
 	conn    *textproto.Conn
-	local   snet.Addr
-	remote  snet.Addr
+	local   string
+	remote  string // Remote host without port
 	logger  Logger
 
+	// Transport for data connections, with the data path policy applied
+	dataTransport transport.Transport
+
 	// Server capabilities discovered at runtime
 	features      map[string]string
 	skipEPSV      bool
 	mlstSupported bool
 	extendedMode  bool
-	maxChunkSize  int
+	acknowledge   bool // Striped transfers acknowledge segments
+	protected     bool // Data connections use TLS, see PROT
+
+	// The reply concluding the transfer in progress, see watchTransfer
+	response    chan error
+	rangeMarker func(striping.Ranges) // Set by ResumeStor
 }
 
 // DialOption represents an option to start a new connection with DialAddr
@@ -50,14 +61,29 @@ type DialOption struct {
 
 // dialOptions contains all the options set by DialOption.setup
 type dialOptions struct {
-	context     context.Context
-	dialer      net.Dialer
-	tlsConfig   *tls.Config
-	conn        scion.Conn
-	disableEPSV bool
-	location    *time.Location
-	debugOutput io.Writer
-	dialFunc    func(network, address string) (net.Conn, error)
+	context        context.Context
+	dialer         net.Dialer
+	tlsConfig      *tls.Config
+	explicitTLS    bool // AUTH TLS instead of implicit FTPS
+	clearData      bool // PROT C instead of P
+	conn           scion.Conn
+	transport      transport.Transport
+	pathPolicy     scion.PathPolicy
+	dataPathPolicy scion.PathPolicy
+	disableEPSV    bool
+	redial         bool
+	active         bool // The server connects to the client
+	acceptTimeout  time.Duration
+	checksums      bool
+	verify         string // Algorithm to verify transfers with
+	parallelism    int
+	adaptive       socket.Adaptive
+	scheduler      socket.Scheduler
+	receiveBuffer  int
+	perfMarker     func(PerfMarker)
+	location       *time.Location
+	debugOutput    io.Writer
+	dialFunc       func(network, address string) (net.Conn, error)
 }
 
 // Entry describes a file and is returned by List().
@@ -79,10 +105,53 @@ func Dial(local, remote string, options ...DialOption) (*ServerConn, error) {
 		do.location = time.UTC
 	}
 
+	if do.transport == nil {
+		do.transport = transport.Scion{}
+	}
+
+	if do.adaptive.MaxChunkLength == 0 {
+		do.adaptive.MaxChunkLength = 1 << 20
+	}
+
+	if do.adaptive.MinChunkLength == 0 {
+		do.adaptive.MinChunkLength = 1000
+	}
+
+	if do.scheduler == nil {
+		do.scheduler = &socket.Weighted{}
+	}
+
+	if do.receiveBuffer == 0 {
+		do.receiveBuffer = socket.BufferSize
+	}
+
+	if do.acceptTimeout == 0 {
+		do.acceptTimeout = time.Minute
+	}
+
+	if do.verify != "" {
+		algorithm, err := checksum.Name(do.verify)
+		if err != nil {
+			return nil, err
+		}
+		do.verify = algorithm
+	}
+
+	host, _, err := transport.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	if do.tlsConfig != nil && do.tlsConfig.ServerName == "" {
+		do.tlsConfig = do.tlsConfig.Clone()
+		do.tlsConfig.ServerName = transport.HostName(host)
+	}
+
 	tconn := do.conn
 	if tconn == nil {
 
-		t, err := scion.DialAddr(local, remote)
+		control := transport.WithPathPolicy(do.transport, do.pathPolicy)
+		t, err := control.Dial(local, remote)
 		tconn = t
 
 		if err != nil {
@@ -91,28 +160,24 @@ func Dial(local, remote string, options ...DialOption) (*ServerConn, error) {
 
 	}
 
-	var sourceConn io.ReadWriteCloser = tconn
-	if do.debugOutput != nil {
-		sourceConn = newDebugWrapper(tconn, do.debugOutput)
+	if do.tlsConfig != nil && !do.explicitTLS {
+		tconn = transport.TLSClient(tconn, do.tlsConfig)
 	}
 
-	conn := textproto.NewConn(sourceConn)
-
-	rm := tconn.RemoteAddr()
-	lc, err := snet.AddrFromString(local)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse local address: %s", err)
+	c := &ServerConn{
+		options:  do,
+		features: make(map[string]string),
+		local:    local,
+		remote:   host,
+		logger:   &StdLogger{},
 	}
+	c.setControlConn(tconn)
 
-	c := &ServerConn{
-		options:      do,
-		features:     make(map[string]string),
-		conn:         conn,
-		local:        *lc,
-		remote:       rm,
-		logger:       &StdLogger{},
-		maxChunkSize: 1000,
+	dataPathPolicy := do.dataPathPolicy
+	if dataPathPolicy == nil {
+		dataPathPolicy = do.pathPolicy
 	}
+	c.dataTransport = transport.WithPathPolicy(do.transport, dataPathPolicy)
 
 	_, _, err = c.conn.ReadResponse(StatusReady)
 
@@ -121,6 +186,22 @@ func Dial(local, remote string, options ...DialOption) (*ServerConn, error) {
 		return nil, err
 	}
 
+	if do.explicitTLS {
+		_, _, err = c.cmd(StatusAuthOK, "AUTH TLS")
+		if err != nil {
+			c.Quit()
+			return nil, err
+		}
+
+		tlsConn := transport.TLSClient(tconn, do.tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			tconn.Close()
+			return nil, err
+		}
+		c.setControlConn(tlsConn)
+	}
+
 	err = c.feat()
 	if err != nil {
 		c.Quit()
@@ -131,9 +212,61 @@ func Dial(local, remote string, options ...DialOption) (*ServerConn, error) {
 		c.mlstSupported = true
 	}
 
+	if do.parallelism > 0 {
+		err = c.SetParallelism(do.parallelism)
+		if err != nil {
+			c.Quit()
+			return nil, err
+		}
+	}
+
+	// Acknowledgements allow striped transfers to continue if
+	// streams fail, but GridFTP servers don't know about them
+	if _, ackSupported := c.features["ACKNOWLEDGE"]; ackSupported {
+		_, _, err = c.cmd(StatusCommandOK, "OPTS RETR Acknowledge=true;")
+		if err != nil {
+			c.Quit()
+			return nil, err
+		}
+		c.acknowledge = true
+	}
+
+	if do.checksums {
+		if _, checksumsSupported := c.features["CHECKSUMS"]; !checksumsSupported {
+			c.Quit()
+			return nil, fmt.Errorf("server does not support segment checksums")
+		}
+
+		_, _, err = c.cmd(StatusCommandOK, "OPTS RETR Checksums=true;")
+		if err != nil {
+			c.Quit()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
+// setControlConn reads and writes the control connection over conn
+func (server *ServerConn) setControlConn(conn scion.Conn) {
+	var sourceConn io.ReadWriteCloser = conn
+	if server.options.debugOutput != nil {
+		sourceConn = newDebugWrapper(conn, server.options.debugOutput)
+	}
+
+	server.conn = textproto.NewConn(sourceConn)
+}
+
+// protect secures a data connection with TLS after PROT P. Independent
+// of who connected, the client takes the role of the TLS client
+func (server *ServerConn) protect(conn scion.Conn) scion.Conn {
+	if !server.protected {
+		return conn
+	}
+
+	return transport.TLSClient(conn, server.options.tlsConfig)
+}
+
 // DialWithTimeout returns a DialOption that configures the ServerConn with specified timeout
 func DialWithTimeout(timeout time.Duration) DialOption {
 	return DialOption{func(do *dialOptions) {
@@ -155,6 +288,143 @@ func DialWithNetConn(conn scion.Conn) DialOption {
 	}}
 }
 
+// DialWithTransport returns a DialOption that configures the ServerConn to use the
+// specified transport for both control and data connections, defaults to SCION
+func DialWithTransport(t transport.Transport) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.transport = t
+	}}
+}
+
+// DialWithPathPolicy returns a DialOption that configures the ServerConn to select
+// the SCION paths of both control and data connections with the specified policy,
+// e.g. scion.AvoidIA to never route through a specific AS
+func DialWithPathPolicy(policy scion.PathPolicy) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.pathPolicy = policy
+	}}
+}
+
+// DialWithDataPathPolicy returns a DialOption that configures the ServerConn to select
+// the SCION paths of data connections with the specified policy, overriding
+// the policy set by DialWithPathPolicy. In active mode the server dials the data
+// connections, over the paths selected by server.ServerOpts.PathPolicy instead
+func DialWithDataPathPolicy(policy scion.PathPolicy) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataPathPolicy = policy
+	}}
+}
+
+// DialWithRedial returns a DialOption that configures the ServerConn to replace
+// failed data connections of striped transfers with new ones. Independent of this
+// option, data of a failed connection is sent again over the remaining connections.
+// Both require a server that acknowledges segments, which GridFTP servers don't
+func DialWithRedial(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.redial = enabled
+	}}
+}
+
+// DialWithActiveMode returns a DialOption that configures the ServerConn to
+// listen for the data connections, which the server connects to, e.g. if a
+// firewall in front of the server blocks incoming connections. Striped
+// transfers use as many streams as set by DialWithParallelism, or a single
+// one otherwise. The local address passed to Dial has to be reachable
+func DialWithActiveMode(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.active = enabled
+	}}
+}
+
+// DialWithAcceptTimeout returns a DialOption that configures how long the
+// ServerConn waits for the server to connect in active mode, once the transfer
+// command has been sent. Defaults to 1 minute
+func DialWithAcceptTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.acceptTimeout = timeout
+	}}
+}
+
+// DialWithChecksums returns a DialOption that configures the ServerConn to add
+// a checksum to each segment of striped transfers, which the receiver verifies.
+// A corrupted segment is sent again if the server acknowledges segments, the
+// transfer fails otherwise. Requires a server that supports it, which GridFTP
+// servers don't
+func DialWithChecksums(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.checksums = enabled
+	}}
+}
+
+// DialWithVerify returns a DialOption that configures the ServerConn to verify
+// the data of Retr, RetrToFile and Stor once the transfer is done, by comparing
+// its hash with the hash the server computes with the algorithm, one of
+// checksum.Algorithms. Transfers of data that doesn't match fail
+func DialWithVerify(algorithm string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.verify = algorithm
+	}}
+}
+
+// DialWithChunkLength returns a DialOption that configures the bounds of the
+// segment length when sending in parallel mode, in between the length is adapted
+// to the measured throughput. Defaults to 1000 and 1 MiB. Servers that don't
+// acknowledge segments always get segments of the maximum length
+func DialWithChunkLength(min, max int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.adaptive.MinChunkLength = min
+		do.adaptive.MaxChunkLength = max
+	}}
+}
+
+// DialWithAdaptiveStreams returns a DialOption that configures the ServerConn to
+// use parallel streams that are considerably slower than the others only occasionally.
+// Requires a server that acknowledges segments, all streams are used otherwise
+func DialWithAdaptiveStreams(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.adaptive.AdaptStreams = enabled
+	}}
+}
+
+// DialWithScheduler returns a DialOption that configures how the ServerConn
+// distributes segments over the parallel streams. Defaults to socket.Weighted.
+// Requires a server that acknowledges segments, otherwise each segment is sent
+// over the first stream that is ready
+func DialWithScheduler(scheduler socket.Scheduler) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.scheduler = scheduler
+	}}
+}
+
+// DialWithReceiveBuffer returns a DialOption that limits the number of bytes
+// buffered to reassemble the data received over parallel streams in order.
+// Longer segments fail their stream, it has to exceed the chunk length of the
+// server. Defaults to socket.BufferSize
+func DialWithReceiveBuffer(size int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.receiveBuffer = size
+	}}
+}
+
+// DialWithParallelism returns a DialOption that configures the ServerConn to
+// request the specified number of parallel streams for striped transfers,
+// the server might limit the number of streams
+func DialWithParallelism(n int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.parallelism = n
+	}}
+}
+
+// DialWithPerfMarkers returns a DialOption that configures the ServerConn to pass
+// the performance markers the server sends during transfers in extended block
+// mode to f, which reports the progress of each stream. f is called from
+// another goroutine and must not issue commands on the ServerConn
+func DialWithPerfMarkers(f func(PerfMarker)) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.perfMarker = f
+	}}
+}
+
 // DialWithDisabledEPSV returns a DialOption that configures the ServerConn with EPSV disabled
 // Note that EPSV is only used when advertised in the server features.
 func DialWithDisabledEPSV(disabled bool) DialOption {
@@ -181,15 +451,36 @@ func DialWithContext(ctx context.Context) DialOption {
 
 // DialWithTLS returns a DialOption that configures the ServerConn with specified TLS config
 //
-// If called together with the DialWithDialFunc option, the DialWithDialFunc function
-// will be used when dialing new connections but regardless of the function,
-// the connection will be treated as a TLS connection.
+// The control connection uses TLS right away (implicit FTPS), data connections
+// are secured with PROT P after logging in. If the config doesn't set ServerName,
+// the host of the server is verified, which is the IP address without the
+// ISD-AS for SCION addresses. The certificate has to contain this address,
+// otherwise set ServerName to the name it was issued for
 func DialWithTLS(tlsConfig *tls.Config) DialOption {
 	return DialOption{func(do *dialOptions) {
 		do.tlsConfig = tlsConfig
 	}}
 }
 
+// DialWithExplicitTLS returns a DialOption that configures the ServerConn to
+// secure the control connection with AUTH TLS once connected (RFC 4217), see
+// DialWithTLS
+func DialWithExplicitTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.tlsConfig = tlsConfig
+		do.explicitTLS = true
+	}}
+}
+
+// DialWithClearData returns a DialOption that configures the ServerConn to
+// keep data connections in clear (PROT C) although the control connection
+// uses TLS, e.g. for third-party copies. Servers may refuse it
+func DialWithClearData(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.clearData = enabled
+	}}
+}
+
 // DialWithDebugOutput returns a DialOption that configures the ServerConn to write to the Writer
 // everything it reads from the server
 func DialWithDebugOutput(w io.Writer) DialOption {
@@ -0,0 +1,62 @@
+package ftp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PerfMarker reports the progress of a single stream during a transfer in
+// extended block mode. GridFTP servers send one for each stripe every now
+// and then, and a final one once the transfer completed
+type PerfMarker struct {
+	Timestamp   time.Time
+	StripeIndex int
+	StripeBytes uint64 // Bytes transferred over the stripe so far
+	StripeCount int
+}
+
+// parsePerfMarker parses the lines of a 112 reply, e.g.
+//
+//	Perf Marker
+//	 Timestamp: 1111111111.1
+//	 Stripe Index: 0
+//	 Stripe Bytes Transferred: 12345
+//	 Total Stripe Count: 2
+//	END
+func parsePerfMarker(message string) (PerfMarker, error) {
+	var marker PerfMarker
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(message, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	timestamp, err := strconv.ParseFloat(fields["Timestamp"], 64)
+	if err != nil {
+		return marker, fmt.Errorf("invalid timestamp: %s", err)
+	}
+	seconds := int64(timestamp)
+	marker.Timestamp = time.Unix(seconds, int64((timestamp-float64(seconds))*float64(time.Second)))
+
+	marker.StripeIndex, err = strconv.Atoi(fields["Stripe Index"])
+	if err != nil {
+		return marker, fmt.Errorf("invalid stripe index: %s", err)
+	}
+
+	marker.StripeBytes, err = strconv.ParseUint(fields["Stripe Bytes Transferred"], 10, 64)
+	if err != nil {
+		return marker, fmt.Errorf("invalid stripe bytes: %s", err)
+	}
+
+	marker.StripeCount, err = strconv.Atoi(fields["Total Stripe Count"])
+	if err != nil {
+		return marker, fmt.Errorf("invalid stripe count: %s", err)
+	}
+
+	return marker, nil
+}
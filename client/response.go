@@ -1,6 +1,7 @@
 package ftp
 
 import (
+	"github.com/elwin/transmit/checksum"
 	"github.com/elwin/transmit/socket"
 	"io"
 	"time"
@@ -8,7 +9,7 @@ import (
 
 // Response represents a data-connection
 type Response interface {
-	io.Reader
+	io.ReadCloser
 	SetDeadline(time time.Time) error
 }
 
@@ -19,30 +20,40 @@ type ConnResponse struct {
 	conn   socket.DataSocket
 	c      *ServerConn
 	closed bool
+	verify *verifyingReader // Set if DialWithVerify is
 }
 
 // Read implements the io.Reader interface on a FTP data connection.
 func (r *ConnResponse) Read(buf []byte) (int, error) {
-	return r.conn.Read(buf)
+	n, err := r.conn.Read(buf)
+	if r.verify != nil {
+		r.verify.read(buf[:n], err)
+	}
+
+	return n, err
 }
 
 // Close implements the io.Closer interface on a FTP data connection.
-// After the first call, Close will do nothing and return nil.
-/*
+// After the first call, Close will do nothing and return nil. If all
+// data has been read and DialWithVerify is set, it also verifies the data.
 func (r *ConnResponse) Close() error {
 
 	if r.closed {
 		return nil
 	}
 	err := r.conn.Close()
-	_, _, err2 := r.c.conn.ReadResponse(StatusClosingDataConnection)
+	err2 := r.c.transferResponse()
 	if err2 != nil {
 		err = err2
 	}
 
+	if err == nil && r.verify != nil && r.verify.complete {
+		err = r.c.verify(r.verify.path, r.verify.offset, checksum.Hex(r.verify.hash))
+	}
+
 	r.closed = true
 	return err
-}*/
+}
 
 // SetDeadline sets the deadlines associated with the connection.
 func (r *ConnResponse) SetDeadline(t time.Time) error {
@@ -0,0 +1,253 @@
+package ftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/striping"
+)
+
+// MarkerInterval is how often ResumeRetr records the ranges it received
+var MarkerInterval = time.Second
+
+// ResumeRetr issues a RETR FTP command to fetch the specified file in extended
+// block mode and writes it to file, like RetrToFile. The ranges received are
+// recorded in the file at markers. If the transfer is interrupted, calling
+// ResumeRetr again with the same marker file only fetches the missing ranges
+// by issuing a REST FTP command with the ranges received. The marker file is
+// removed once the transfer completed.
+//
+// The server needs to be able to read files at arbitrary offsets.
+func (server *ServerConn) ResumeRetr(path string, file *os.File, markers string) error {
+	if !server.extendedMode {
+		return fmt.Errorf("resuming transfers requires extended block mode")
+	}
+
+	received, err := loadMarkers(markers)
+	if err != nil {
+		return err
+	}
+
+	conn, err := server.cmdDataConnRest(received.String(), "RETR %s", path)
+	if err != nil {
+		return err
+	}
+	response := &ConnResponse{conn: conn, c: server}
+	striped, ok := conn.(*socket.MultiSocket)
+	if !ok {
+		response.Close()
+		return fmt.Errorf("data connection is not striped")
+	}
+	striped.Resume(received)
+
+	// Ranges only count once they have been written to disk
+	save := func() error {
+		ranges := striped.Received()
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		return saveMarkers(markers, ranges)
+	}
+
+	// Once saving failed, the marker file keeps the ranges saved
+	// before, which are fewer than received but still correct
+	var saveErr error
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(MarkerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if saveErr == nil {
+					saveErr = save()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	_, err = striped.CopyTo(file)
+	close(stop)
+	<-done
+
+	if closeErr := response.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		if saveErr == nil {
+			saveErr = save()
+		}
+		if saveErr != nil {
+			return fmt.Errorf("%v, failed to record the ranges received: %v", err, saveErr)
+		}
+		return err
+	}
+
+	return removeMarkers(markers)
+}
+
+// ResumeStor issues a STOR FTP command to store file on the remote FTP server
+// in extended block mode. The server reports the ranges it received in
+// restart markers, which are recorded in the file at markers. If the transfer
+// is interrupted, calling ResumeStor again with the same marker file only
+// sends the missing ranges, after issuing a REST FTP command with the ranges
+// the server received. The marker file is removed once the transfer completed.
+//
+// The server needs to be able to write files at arbitrary offsets.
+func (server *ServerConn) ResumeStor(path string, file *os.File, markers string) error {
+	if !server.extendedMode {
+		return fmt.Errorf("resuming transfers requires extended block mode")
+	}
+
+	received, err := loadMarkers(markers)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The restart markers arrive while sending, which the transfer
+	// response waits for. Once saving failed, the marker file
+	// keeps the ranges saved before
+	var saveErr error
+	server.rangeMarker = func(ranges striping.Ranges) {
+		if saveErr == nil {
+			saveErr = saveMarkers(markers, ranges)
+		}
+	}
+	defer func() {
+		server.rangeMarker = nil
+	}()
+
+	conn, err := server.cmdDataConnRest(received.String(), "STOR %s", path)
+	if err != nil {
+		return err
+	}
+	striped, ok := conn.(*socket.MultiSocket)
+	if !ok {
+		conn.Close()
+		server.transferResponse()
+		return fmt.Errorf("data connection is not striped")
+	}
+
+	_, err = striped.CopyRanges(file, received.Missing(0, uint64(info.Size())))
+	if closeErr := striped.Close(); err == nil {
+		err = closeErr
+	}
+	if responseErr := server.transferResponse(); err == nil {
+		err = responseErr
+	}
+
+	if err != nil {
+		if saveErr != nil {
+			return fmt.Errorf("%v, failed to record the ranges received: %v", err, saveErr)
+		}
+		return err
+	}
+
+	return removeMarkers(markers)
+}
+
+// watchTransfer reads the replies during a transfer in extended block mode
+// in the background, so that markers are passed on as they arrive rather
+// than once the transfer completed. See transferResponse
+func (server *ServerConn) watchTransfer() {
+	response := make(chan error, 1)
+	server.response = response
+
+	go func() {
+		response <- server.readTransferResponse()
+	}()
+}
+
+// transferResponse returns the reply that concludes a data transfer
+func (server *ServerConn) transferResponse() error {
+	if server.response == nil {
+		return server.readTransferResponse()
+	}
+
+	err := <-server.response
+	server.response = nil
+
+	return err
+}
+
+// readTransferResponse reads the replies until the one that concludes the
+// transfer. Restart markers are passed to rangeMarker, performance markers
+// to the function set by DialWithPerfMarkers
+func (server *ServerConn) readTransferResponse() error {
+	for {
+		code, message, err := server.conn.ReadResponse(-1)
+		if err != nil {
+			return err
+		}
+		server.logger.PrintResponse(code, message)
+
+		switch code {
+		case StatusRangeMarker:
+			ranges, err := striping.ParseRanges(strings.TrimPrefix(message, "Range Marker "))
+			if err == nil && server.rangeMarker != nil {
+				server.rangeMarker(ranges)
+			}
+		case StatusPerfMarker:
+			marker, err := parsePerfMarker(message)
+			if err == nil && server.options.perfMarker != nil {
+				server.options.perfMarker(marker)
+			}
+		case StatusClosingDataConnection:
+			return nil
+		default:
+			return &textproto.Error{Code: code, Msg: message}
+		}
+	}
+}
+
+// loadMarkers returns the ranges recorded in the marker file,
+// which are none if it doesn't exist
+func loadMarkers(path string) (striping.Ranges, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return striping.ParseRanges(string(data))
+}
+
+// saveMarkers replaces the marker file in one step, an
+// interruption leaves either the previous or the new ranges
+func saveMarkers(path string, ranges striping.Ranges) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(ranges.String()), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func removeMarkers(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
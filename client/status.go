@@ -4,6 +4,8 @@ package ftp
 const (
 	StatusInitiating    = 100
 	StatusRestartMarker = 110
+	StatusRangeMarker   = 111 // GridFTP restart marker in extended block mode
+	StatusPerfMarker    = 112 // GridFTP performance marker
 	StatusReadyMinute   = 120
 	StatusAlreadyOpen   = 125
 	StatusAboutToSend   = 150
@@ -25,6 +27,7 @@ const (
 	StatusLoggedIn              = 230
 	StatusLoggedOut             = 231
 	StatusLogoutAck             = 232
+	StatusAuthOK                = 234 // RFC 2228
 	StatusRequestedFileActionOK = 250
 	StatusPathCreated           = 257
 
@@ -73,6 +76,7 @@ var statusText = map[int]string{
 	StatusLoggedIn:              "User logged in, proceed.",
 	StatusLoggedOut:             "User logged out; service terminated.",
 	StatusLogoutAck:             "Logout command noted, will complete when transfer done.",
+	StatusAuthOK:                "Security data exchange complete.",
 	StatusRequestedFileActionOK: "Requested file action okay, completed.",
 	StatusPathCreated:           "Path created.",
 
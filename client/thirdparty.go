@@ -0,0 +1,151 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/elwin/transmit/transport"
+)
+
+// ThirdPartyCopy copies the file at path from src to the same path on dst.
+// The data moves directly between the servers, only the control connections
+// go through the client: dst listens with SPAS, or EPSV in stream mode, and
+// src connects to it with SPOR or EPRT. Both connections have to be in the
+// same mode with the same options negotiated. src has to allow connecting
+// to dst, see server.ServerOpts.ThirdPartyHosts.
+// If the data connections are protected, they have to be on both, then src
+// takes the role of the TLS client after SSCN ON, which it is switched
+// back from afterwards. The servers don't authenticate each other
+func ThirdPartyCopy(src, dst *ServerConn, path string) (err error) {
+	if src.extendedMode != dst.extendedMode {
+		return errors.New("servers are not in the same transfer mode")
+	}
+	if src.acknowledge != dst.acknowledge || src.options.checksums != dst.options.checksums {
+		return errors.New("servers negotiated different extended block mode options")
+	}
+
+	if src.protected != dst.protected {
+		return errors.New("data connections are protected on only one of the servers, see DialWithClearData")
+	}
+
+	// Otherwise both servers would take the role of the TLS server
+	if src.protected {
+		_, _, err = src.cmd(StatusCommandOK, "SSCN ON")
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_, _, err2 := src.cmd(StatusCommandOK, "SSCN OFF")
+			if err == nil {
+				err = err2
+			}
+		}()
+	}
+
+	err = connectServers(src, dst)
+	if err != nil {
+		return err
+	}
+
+	// A missing source file fails
+	// before the target is created
+	err = src.startTransfer("RETR %s", path)
+	if err != nil {
+		return err
+	}
+
+	err = dst.startTransfer("STOR %s", path)
+	if err != nil {
+		src.transferResponse()
+		return err
+	}
+
+	err = src.transferResponse()
+	if err2 := dst.transferResponse(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	algorithm := dst.options.verify
+	if algorithm == "" {
+		algorithm = src.options.verify
+	}
+	if algorithm == "" {
+		return nil
+	}
+
+	// Only one of the connections might have been dialed with
+	// DialWithVerify, both hash the file with the same algorithm
+	local, err := src.checksumFrom(path, algorithm, 0)
+	if err != nil {
+		return err
+	}
+
+	remote, err := dst.checksumFrom(path, algorithm, 0)
+	if err != nil {
+		return err
+	}
+
+	if remote != local {
+		return fmt.Errorf("checksum mismatch for %s: source %s, target %s", path, local, remote)
+	}
+
+	return nil
+}
+
+// connectServers sets up the data connection from src to dst
+func connectServers(src, dst *ServerConn) error {
+	if src.extendedMode {
+		addrs, err := dst.spas()
+		if err != nil {
+			return err
+		}
+
+		param, err := sporParam(addrs)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = src.cmd(StatusCommandOK, "SPOR %s", param)
+		return err
+	}
+
+	port, err := dst.epsv()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = src.cmd(StatusCommandOK, "EPRT %s", eprtParam(dst.remote, port))
+	return err
+}
+
+// sporParam formats the parameters of an SPOR command from addresses
+// of the form host:port, see transport.JoinStripe
+func sporParam(addrs []string) (string, error) {
+	stripes := make([]string, len(addrs))
+	for i, addr := range addrs {
+		host, port, err := transport.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		stripes[i] = transport.JoinStripe(host, port)
+	}
+
+	return strings.Join(stripes, " "), nil
+}
+
+// eprtParam formats the parameter of an EPRT command, the address family
+// is 2 for IPv6 addresses and 1 for anything else, e.g. SCION addresses
+func eprtParam(host string, port int) string {
+	family := 1
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		family = 2
+	}
+
+	return fmt.Sprintf("|%d|%s|%d|", family, host, port)
+}
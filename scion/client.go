@@ -3,19 +3,44 @@ package scion
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/snet/squic"
 	"io"
 )
 
-func Dial(local, remote snet.Addr) (Conn, error) {
+// Dial connects to remote over the path preferred by the policy,
+// a nil policy picks the shortest path
+func Dial(local, remote snet.Addr, policy PathPolicy) (Conn, error) {
 
 	err := initNetwork(local)
 	if err != nil {
 		return nil, err
 	}
 
-	setupPath(local, remote)
+	path, err := choosePath(local, remote, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return DialPath(local, remote, path)
+}
+
+// DialPath connects to remote over the given path,
+// which may be nil if both are in the same AS
+func DialPath(local, remote snet.Addr, path *sciond.PathReplyEntry) (Conn, error) {
+
+	err := initNetwork(local)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setupPath(local, &remote, path)
+	if err != nil {
+		return nil, err
+	}
 
 	session, err := squic.DialSCION(nil, &local, &remote, nil)
 	if err != nil {
@@ -35,7 +60,102 @@ func Dial(local, remote snet.Addr) (Conn, error) {
 	return NewConnection(stream, local, remote), nil
 }
 
-func DialAddr(localAddr, remoteAddr string) (Conn, error) {
+func DialAddr(localAddr, remoteAddr string, policy PathPolicy) (Conn, error) {
+
+	local, err := snet.AddrFromString(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := snet.AddrFromString(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return Dial(*local, *remote, policy)
+}
+
+// DialMultipath opens a connection to each of the remotes and spreads
+// them across as many distinct paths as possible, see ChoosePaths.
+// Only paths that satisfy the policy are considered
+func DialMultipath(local snet.Addr, remotes []snet.Addr, policy PathPolicy) ([]Conn, error) {
+	paths := make(map[addr.IA][]*sciond.PathReplyEntry)
+	count := make(map[addr.IA]int)
+
+	for _, remote := range remotes {
+		if _, ok := paths[remote.IA]; !ok {
+			available, err := QueryPaths(local, remote)
+			if err != nil {
+				return nil, err
+			}
+
+			available, err = applyPolicy(policy, available)
+			if err != nil {
+				return nil, err
+			}
+			paths[remote.IA] = available
+		}
+		count[remote.IA]++
+	}
+
+	for ia := range paths {
+		paths[ia] = ChoosePaths(paths[ia], count[ia])
+	}
+
+	var conns []Conn
+	for _, remote := range remotes {
+		var path *sciond.PathReplyEntry
+		if chosen := paths[remote.IA]; len(chosen) > 0 {
+			path, paths[remote.IA] = chosen[0], chosen[1:]
+			log.Debug("Using path", "remote", AddrToString(remote), "path", path.Path.String())
+		}
+
+		conn, err := DialPath(local, remote, path)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	return conns, nil
+}
+
+// DialReplacement connects to remote as the n-th of the connections
+// spread by DialMultipath, counting from zero. The path continues the
+// rotation of ChoosePaths over the currently available paths, so that
+// a replacement for a failed connection avoids the paths in use,
+// including the one that failed, as long as there are others
+func DialReplacement(local, remote snet.Addr, policy PathPolicy, n int) (Conn, error) {
+
+	err := initNetwork(local)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := QueryPaths(local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err = applyPolicy(policy, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var path *sciond.PathReplyEntry
+	if chosen := ChoosePaths(paths, n+1); len(chosen) > 0 {
+		path = chosen[n]
+		log.Debug("Using path", "remote", AddrToString(remote), "path", path.Path.String())
+	}
+
+	return DialPath(local, remote, path)
+}
+
+func DialReplacementAddr(localAddr, remoteAddr string, policy PathPolicy, n int) (Conn, error) {
 
 	local, err := snet.AddrFromString(localAddr)
 	if err != nil {
@@ -47,7 +167,26 @@ func DialAddr(localAddr, remoteAddr string) (Conn, error) {
 		return nil, err
 	}
 
-	return Dial(*local, *remote)
+	return DialReplacement(*local, *remote, policy, n)
+}
+
+func DialMultipathAddr(localAddr string, remoteAddrs []string, policy PathPolicy) ([]Conn, error) {
+
+	local, err := snet.AddrFromString(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := make([]snet.Addr, len(remoteAddrs))
+	for i, remoteAddr := range remoteAddrs {
+		remote, err := snet.AddrFromString(remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		remotes[i] = *remote
+	}
+
+	return DialMultipath(*local, remotes, policy)
 }
 
 func sendHandshake(rw io.ReadWriter) error {
@@ -1,13 +1,15 @@
 package scion
 
 import (
+	"net"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
-// Copied from the net package and replaced net.Addr with snet.Addr
+// Copied from the net package, addresses are kept generic
+// so that other transports can provide connections as well
 type Conn interface {
 	// Read reads data from the connection.
 	// Read can be made to time out and return an Error with Timeout() == true
@@ -23,11 +25,11 @@ type Conn interface {
 	// Any blocked Read or ReadFrom operations will be unblocked and return errors.
 	Close() error
 
-	// LocalAddr returns the Local network Local.
-	LocalAddr() snet.Addr
+	// LocalAddr returns the local network address.
+	LocalAddr() net.Addr
 
-	// RemoteAddr returns the Local network Local.
-	RemoteAddr() snet.Addr
+	// RemoteAddr returns the remote network address.
+	RemoteAddr() net.Addr
 
 	// SetDeadline sets the read and write deadlines associated
 	// with the connection. It is equivalent to calling both
@@ -83,12 +85,12 @@ func (connection *connection) Write(b []byte) (n int, err error) {
 	return connection.Stream.Write(b)
 }
 
-func (connection *connection) LocalAddr() snet.Addr {
-	return connection.Local
+func (connection *connection) LocalAddr() net.Addr {
+	return &connection.Local
 }
 
-func (connection *connection) RemoteAddr() snet.Addr {
-	return connection.Remote
+func (connection *connection) RemoteAddr() net.Addr {
+	return &connection.Remote
 }
 
 func (connection *connection) Close() error {
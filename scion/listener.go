@@ -6,11 +6,12 @@ import (
 	"github.com/lucas-clemente/quic-go"
 	"github.com/scionproto/scion/go/lib/snet"
 	"io"
+	"net"
 	"strings"
 )
 
 type Listener interface {
-	Addr() snet.Addr
+	Addr() net.Addr
 	Close() error
 	Accept() (Conn, error)
 }
@@ -22,8 +23,10 @@ type ScionListener struct {
 	local        snet.Addr
 }
 
-func (listener ScionListener) Addr() snet.Addr {
-	return listener.local
+// Addr returns the address the listener is bound to,
+// including the port allocated by the dispatcher
+func (listener ScionListener) Addr() net.Addr {
+	return &listener.local
 }
 
 func (listener ScionListener) Close() error {
@@ -3,60 +3,129 @@ package scion
 import (
 	"context"
 	"fmt"
+	"sort"
+
+	"github.com/scionproto/scion/go/lib/log"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/spath"
 )
 
-func setupPath(local, remote snet.Addr) error {
-	if !remote.IA.Eq(local.IA) {
-		pathEntry := choosePath(local, remote)
-		if pathEntry == nil {
-			return fmt.Errorf("no paths available to remote destination")
-		}
-		remote.Path = spath.New(pathEntry.Path.FwdPath)
-		remote.Path.InitOffsets()
-		remote.NextHop, _ = pathEntry.HostInfo.Overlay()
+// setupPath configures the remote address to be reached over
+// the given path, the path is ignored within the same AS
+func setupPath(local snet.Addr, remote *snet.Addr, pathEntry *sciond.PathReplyEntry) error {
+	if remote.IA.Eq(local.IA) {
+		return nil
+	}
+
+	if pathEntry == nil {
+		return fmt.Errorf("no paths available to remote destination")
+	}
+
+	remote.Path = spath.New(pathEntry.Path.FwdPath)
+	err := remote.Path.InitOffsets()
+	if err != nil {
+		return fmt.Errorf("failed to initialize path: %s", err)
+	}
+
+	remote.NextHop, err = pathEntry.HostInfo.Overlay()
+	if err != nil {
+		return fmt.Errorf("failed to determine next hop: %s", err)
 	}
 
 	return nil
 }
 
-func choosePath(local, remote snet.Addr) *sciond.PathReplyEntry {
-	var paths []*sciond.PathReplyEntry
-	var pathIndex uint64
+// QueryPaths returns all paths from local to remote known to the
+// path resolver, ordered by the number of hops. The result is
+// empty if both are located in the same AS
+func QueryPaths(local, remote snet.Addr) ([]*sciond.PathReplyEntry, error) {
+	err := initNetwork(local)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote.IA.Eq(local.IA) {
+		return nil, nil
+	}
 
 	pathMgr := snet.DefNetwork.PathResolver()
 	pathSet := pathMgr.Query(context.Background(), local.IA, remote.IA)
 
 	if len(pathSet) == 0 {
-		return nil
+		return nil, fmt.Errorf("no paths available to %s", remote.IA)
 	}
+
+	var paths []*sciond.PathReplyEntry
 	for _, p := range pathSet {
 		paths = append(paths, p.Entry)
 	}
 
-	/*
-		if interactive {
-			fmt.Printf("Available paths to %v\n", remote.IA)
-			for i := range paths {
-				fmt.Printf("[%2d] %s\n", i, paths[i].Path.String())
+	// The path set is a map, sort it to get a stable order
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := paths[i].Path, paths[j].Path
+		if len(a.Interfaces) != len(b.Interfaces) {
+			return len(a.Interfaces) < len(b.Interfaces)
+		}
+		return a.String() < b.String()
+	})
+
+	return paths, nil
+}
+
+// choosePath picks the path for a single connection,
+// which is the most preferred path according to the policy
+func choosePath(local, remote snet.Addr, policy PathPolicy) (*sciond.PathReplyEntry, error) {
+	paths, err := QueryPaths(local, remote)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	paths, err = applyPolicy(policy, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Using path", "path", paths[0].Path.String())
+	return paths[0], nil
+}
+
+// ChoosePaths picks a path for each of n parallel connections.
+// Paths are assigned such that every path is used once before
+// any path is used twice, and among the unused paths the one that
+// shares the fewest interfaces with the already chosen paths
+// is preferred. Ties are broken by the order of the paths.
+func ChoosePaths(paths []*sciond.PathReplyEntry, n int) []*sciond.PathReplyEntry {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	chosen := make([]*sciond.PathReplyEntry, 0, n)
+	usage := make([]int, len(paths))
+	interfaces := make(map[sciond.PathInterface]int)
+
+	for len(chosen) < n {
+		best, bestShared := -1, 0
+
+		for i, path := range paths {
+			shared := 0
+			for _, iface := range path.Path.Interfaces {
+				shared += interfaces[iface]
 			}
-			reader := bufio.NewReader(os.Stdin)
-			for {
-				fmt.Printf("Choose path: ")
-				pathIndexStr, _ := reader.ReadString('\n')
-				var err error
-				pathIndex, err = strconv.ParseUint(pathIndexStr[:len(pathIndexStr)-1], 10, 64)
-				if err == nil && int(pathIndex) < len(paths) {
-					break
-				}
-				fmt.Fprintf(os.Stderr, "ERROR: Invalid path index, valid indices range: [0, %v]\n",
-					len(paths))
+
+			if best == -1 ||
+				usage[i] < usage[best] ||
+				usage[i] == usage[best] && shared < bestShared {
+				best, bestShared = i, shared
 			}
 		}
-	*/
 
-	fmt.Printf("Using path:\n  %s\n", paths[pathIndex].Path.String())
-	return paths[pathIndex]
+		chosen = append(chosen, paths[best])
+		usage[best]++
+		for _, iface := range paths[best].Path.Interfaces {
+			interfaces[iface]++
+		}
+	}
+
+	return chosen
 }
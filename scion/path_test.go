@@ -0,0 +1,128 @@
+package scion
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+func newTestPath(ifids ...common.IFIDType) *sciond.PathReplyEntry {
+	ia := addr.IA{I: 1, A: 0xff0000000110}
+	var interfaces []sciond.PathInterface
+	for _, ifid := range ifids {
+		interfaces = append(interfaces, sciond.PathInterface{RawIsdas: ia.IAInt(), IfID: ifid})
+	}
+
+	return &sciond.PathReplyEntry{Path: &sciond.FwdPathMeta{Interfaces: interfaces}}
+}
+
+func TestChoosePaths(t *testing.T) {
+	a := newTestPath(1, 2)
+	b := newTestPath(1, 3)
+	c := newTestPath(4, 5, 6, 7)
+	paths := []*sciond.PathReplyEntry{a, b, c}
+
+	var tests = []struct {
+		n        int
+		expected []*sciond.PathReplyEntry
+	}{
+		{0, []*sciond.PathReplyEntry{}},
+		{1, []*sciond.PathReplyEntry{a}},
+		// c is longer, but disjoint to a
+		{2, []*sciond.PathReplyEntry{a, c}},
+		{3, []*sciond.PathReplyEntry{a, c, b}},
+		// Every path is used once before reusing one
+		{4, []*sciond.PathReplyEntry{a, c, b, a}},
+		{6, []*sciond.PathReplyEntry{a, c, b, a, b, c}},
+	}
+
+	for _, tt := range tests {
+		chosen := ChoosePaths(paths, tt.n)
+		if len(chosen) != len(tt.expected) {
+			t.Errorf("ChoosePaths(%d): got %d paths, want %d", tt.n, len(chosen), len(tt.expected))
+			continue
+		}
+		for i := range chosen {
+			if chosen[i] != tt.expected[i] {
+				t.Errorf("ChoosePaths(%d): unexpected path at index %d", tt.n, i)
+			}
+		}
+	}
+
+	if chosen := ChoosePaths(nil, 4); len(chosen) != 0 {
+		t.Errorf("ChoosePaths without paths: got %d paths", len(chosen))
+	}
+}
+
+func newTestPathVia(mtu uint16, ias ...addr.IA) *sciond.PathReplyEntry {
+	var interfaces []sciond.PathInterface
+	for i, ia := range ias {
+		interfaces = append(interfaces, sciond.PathInterface{RawIsdas: ia.IAInt(), IfID: common.IFIDType(i + 1)})
+	}
+
+	return &sciond.PathReplyEntry{Path: &sciond.FwdPathMeta{Mtu: mtu, Interfaces: interfaces}}
+}
+
+func TestPathPolicy(t *testing.T) {
+	src := addr.IA{I: 1, A: 0xff0000000110}
+	dst := addr.IA{I: 1, A: 0xff0000000111}
+	core1 := addr.IA{I: 1, A: 0xff0000000120}
+	core2 := addr.IA{I: 2, A: 0xff0000000210}
+
+	short := newTestPathVia(1280, src, dst)
+	viaCore1 := newTestPathVia(1472, src, core1, core1, dst)
+	viaCore2 := newTestPathVia(1472, src, core2, core2, dst)
+	paths := []*sciond.PathReplyEntry{short, viaCore1, viaCore2}
+
+	var tests = []struct {
+		name     string
+		policy   PathPolicy
+		expected []*sciond.PathReplyEntry
+	}{
+		{"none", nil, []*sciond.PathReplyEntry{short, viaCore1, viaCore2}},
+		{"shortest", ShortestPath(), []*sciond.PathReplyEntry{short, viaCore1, viaCore2}},
+		{"latency", LowestLatency(), []*sciond.PathReplyEntry{short, viaCore1, viaCore2}},
+		{"prefer MTU", PreferMTU(1400), []*sciond.PathReplyEntry{viaCore1, viaCore2, short}},
+		{"min MTU", MinMTU(1400), []*sciond.PathReplyEntry{viaCore1, viaCore2}},
+		{"avoid", AvoidIA(core1), []*sciond.PathReplyEntry{short, viaCore2}},
+		{"avoid ISD", AvoidIA(addr.IA{I: 2}), []*sciond.PathReplyEntry{short, viaCore1}},
+		{"require", RequireIA(core2), []*sciond.PathReplyEntry{viaCore2}},
+		{"chain", Chain(AvoidIA(core2), PreferMTU(1400)), []*sciond.PathReplyEntry{viaCore1, short}},
+		{"interactive", Interactive(strings.NewReader("x\n3\n2\n"), ioutil.Discard),
+			[]*sciond.PathReplyEntry{viaCore2, short, viaCore1}},
+	}
+
+	for _, tt := range tests {
+		selected, err := applyPolicy(tt.policy, paths)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(selected) != len(tt.expected) {
+			t.Errorf("%s: got %d paths, want %d", tt.name, len(selected), len(tt.expected))
+			continue
+		}
+		for i := range selected {
+			if selected[i] != tt.expected[i] {
+				t.Errorf("%s: unexpected path at index %d", tt.name, i)
+			}
+		}
+	}
+
+	// The policy must not modify the paths it is given
+	if paths[0] != short || paths[1] != viaCore1 || paths[2] != viaCore2 {
+		t.Errorf("policy modified the input paths")
+	}
+
+	if _, err := applyPolicy(RequireIA(core1, core2), paths); err == nil {
+		t.Errorf("expected an error if no path satisfies the policy")
+	}
+
+	if _, err := applyPolicy(Interactive(strings.NewReader(""), ioutil.Discard), paths); err == nil {
+		t.Errorf("expected an error if no path is chosen")
+	}
+}
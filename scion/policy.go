@@ -0,0 +1,248 @@
+package scion
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+// PathPolicy filters and orders the available paths to a remote,
+// the first path of the result is preferred. A nil policy keeps
+// the order of QueryPaths, i.e. the shortest path first
+type PathPolicy func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error)
+
+// Chain applies the policies one after another. Sorting is stable,
+// so the last policy determines the order and earlier ones only
+// break ties
+func Chain(policies ...PathPolicy) PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		var err error
+		for _, policy := range policies {
+			paths, err = applyPolicy(policy, paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return paths, nil
+	}
+}
+
+// applyPolicy runs the policy on a copy of the paths and makes sure
+// that at least one path remains
+func applyPolicy(policy PathPolicy, paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+	if policy == nil || len(paths) == 0 {
+		return paths, nil
+	}
+
+	selected, err := policy(append([]*sciond.PathReplyEntry{}, paths...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("none of the %d available paths satisfies the path policy", len(paths))
+	}
+
+	return selected, nil
+}
+
+// ShortestPath prefers paths with fewer hops
+func ShortestPath() PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return len(paths[i].Path.Interfaces) < len(paths[j].Path.Interfaces)
+		})
+
+		return paths, nil
+	}
+}
+
+// LowestLatency prefers paths with the lowest estimated latency.
+// Path metadata does not contain any latency information, hence it is
+// estimated from the hop count, adjusted for the share of each packet
+// that is lost to the headers: a path with a small MTU needs more
+// packets for the same amount of data
+func LowestLatency() PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return estimateLatency(paths[i]) < estimateLatency(paths[j])
+		})
+
+		return paths, nil
+	}
+}
+
+const (
+	// Used if the path does not specify its MTU
+	defaultMTU = 1472
+
+	// Common header, addresses, UDP and QUIC headers, not including
+	// the forwarding path itself
+	headerOverhead = 112
+)
+
+func estimateLatency(path *sciond.PathReplyEntry) float64 {
+	mtu := int(path.Path.Mtu)
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+
+	payload := mtu - headerOverhead - len(path.Path.FwdPath)
+	if payload <= 0 {
+		payload = 1
+	}
+
+	hops := len(path.Path.Interfaces)/2 + 1
+
+	return float64(hops) * float64(mtu) / float64(payload)
+}
+
+// PreferMTU prefers paths with an MTU of at least mtu bytes,
+// the remaining paths are kept as fallback
+func PreferMTU(mtu uint16) PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return paths[i].Path.Mtu >= mtu && paths[j].Path.Mtu < mtu
+		})
+
+		return paths, nil
+	}
+}
+
+// MinMTU removes all paths with an MTU below mtu bytes
+func MinMTU(mtu uint16) PathPolicy {
+	return filter(func(path *sciond.PathReplyEntry) bool {
+		return path.Path.Mtu >= mtu
+	})
+}
+
+// RequireIA only keeps paths that traverse all of the given ASes.
+// A zero AS (e.g. 1-0) matches all ASes of the ISD
+func RequireIA(ias ...addr.IA) PathPolicy {
+	return filter(func(path *sciond.PathReplyEntry) bool {
+		for _, ia := range ias {
+			if !traverses(path, ia) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AvoidIA removes all paths that traverse any of the given ASes.
+// A zero AS (e.g. 1-0) matches all ASes of the ISD
+func AvoidIA(ias ...addr.IA) PathPolicy {
+	return filter(func(path *sciond.PathReplyEntry) bool {
+		for _, ia := range ias {
+			if traverses(path, ia) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func filter(keep func(path *sciond.PathReplyEntry) bool) PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		var kept []*sciond.PathReplyEntry
+		for _, path := range paths {
+			if keep(path) {
+				kept = append(kept, path)
+			}
+		}
+
+		return kept, nil
+	}
+}
+
+func traverses(path *sciond.PathReplyEntry, ia addr.IA) bool {
+	for _, iface := range path.Path.Interfaces {
+		hop := iface.ISD_AS()
+		if (ia.I == 0 || ia.I == hop.I) && (ia.A == 0 || ia.A == hop.A) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseIAs parses a comma separated list of ISD-AS,
+// as used for RequireIA and AvoidIA
+func ParseIAs(s string) ([]addr.IA, error) {
+	var ias []addr.IA
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		ia, err := addr.IAFromString(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISD-AS %s: %s", field, err)
+		}
+		ias = append(ias, ia)
+	}
+
+	return ias, nil
+}
+
+// Interactive lists the paths on out and lets the user choose one from in,
+// the chosen path is moved to the front
+func Interactive(in io.Reader, out io.Writer) PathPolicy {
+	return func(paths []*sciond.PathReplyEntry) ([]*sciond.PathReplyEntry, error) {
+		fmt.Fprintf(out, "Available paths to %s\n", paths[0].Path.DstIA())
+		for i := range paths {
+			fmt.Fprintf(out, "[%2d] %s\n", i, paths[i].Path.String())
+		}
+
+		for {
+			fmt.Fprintf(out, "Choose path: ")
+			line, err := readLine(in)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read path index: %s", err)
+			}
+
+			index, err := strconv.Atoi(strings.TrimSpace(line))
+			if err == nil && index >= 0 && index < len(paths) {
+				chosen := paths[index]
+				copy(paths[1:index+1], paths[:index])
+				paths[0] = chosen
+
+				return paths, nil
+			}
+
+			fmt.Fprintf(out, "Invalid path index, valid indices range: [0, %d]\n", len(paths)-1)
+		}
+	}
+}
+
+// readLine reads byte by byte, so that nothing
+// after the line is consumed from in
+func readLine(in io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for {
+		n, err := in.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+}
@@ -23,8 +23,15 @@ func Listen(address string) (Listener, error) {
 		return nil, fmt.Errorf("unable to listen: %s", err)
 	}
 
+	// The dispatcher allocates a port if none was requested,
+	// which has to be advertised instead of port 0
+	local := *addr
+	if bound, ok := listener.Addr().(*snet.Addr); ok {
+		local = *bound
+	}
+
 	return &ScionListener{
 		listener,
-		*addr,
+		local,
 	}, nil
 }
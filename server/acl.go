@@ -0,0 +1,315 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elwin/transmit/transport"
+)
+
+// ACL allows or denies sessions and single commands by the address of
+// the client. It is configured by rules, one per line:
+//
+//     allow|deny <address> [command ...]
+//
+// The address is either "*" for any client, an ISD-AS such as
+// "1-ff00:0:110", all ASes of an ISD such as "1-*", or any of them
+// followed by hosts such as "1-ff00:0:110,[10.0.0.0/8]". A host or CIDR
+// on its own also matches clients that don't use SCION. Empty lines and
+// lines starting with # are ignored. For example, to restrict write
+// access to our own ASes:
+//
+//     allow 1-ff00:0:110 STOR APPE DELE RNFR RNTO MKD RMD
+//     deny  *            STOR APPE DELE RNFR RNTO MKD RMD
+//
+// Rules without commands apply to whole sessions, the others to the
+// commands they list. In both cases the first rule that matches the
+// client decides, if none does access is allowed. Aliases such as XRMD
+// for RMD are treated as the same command, so a rule for either applies
+// to both. The same goes for the commands that read files, ERET, CKSM and
+// HASH are treated as RETR. The rules can be replaced while the server is
+// running, see Reload
+type ACL struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+type aclRule struct {
+	allow    bool
+	address  aclAddress
+	commands map[string]bool // Empty for the whole session
+}
+
+// NewACL parses the rules of an ACL
+func NewACL(rules string) (*ACL, error) {
+	acl := &ACL{}
+	if err := acl.Reload(rules); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// Reload replaces the rules, which apply to the following commands of
+// established sessions as well. If the rules are invalid, the previous
+// ones are kept
+func (acl *ACL) Reload(rules string) error {
+	var parsed []aclRule
+
+	for i, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", i+1, err)
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	acl.mu.Lock()
+	acl.rules = parsed
+	acl.mu.Unlock()
+
+	return nil
+}
+
+func parseACLRule(line string) (aclRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return aclRule{}, fmt.Errorf("invalid rule %s", line)
+	}
+
+	var rule aclRule
+
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+		rule.allow = false
+	default:
+		return aclRule{}, fmt.Errorf("invalid action %s", fields[0])
+	}
+
+	var err error
+	rule.address, err = parseACLAddress(fields[1])
+	if err != nil {
+		return aclRule{}, err
+	}
+
+	rule.commands = make(map[string]bool)
+	for _, command := range fields[2:] {
+		rule.commands[canonicalCommand(command)] = true
+	}
+
+	return rule, nil
+}
+
+// allowSession reports whether the client at addr may use the server,
+// a nil ACL allows everyone
+func (acl *ACL) allowSession(addr net.Addr) bool {
+	return acl.allow(addr, "")
+}
+
+// allowCommand reports whether the client at addr may run the command
+func (acl *ACL) allowCommand(addr net.Addr, command string) bool {
+	return acl.allow(addr, canonicalCommand(command))
+}
+
+// commandAliases maps commands to the equivalent ones
+// that rules apply to, so that they can't be bypassed
+var commandAliases = map[string]string{
+	"CKSM": "RETR",
+	"ERET": "RETR",
+	"HASH": "RETR",
+	"XCUP": "CDUP",
+	"XCWD": "CWD",
+	"XMKD": "MKD",
+	"XPWD": "PWD",
+	"XRMD": "RMD",
+}
+
+// canonicalCommand returns the upper case name of the command,
+// or of the command it is an alias for
+func canonicalCommand(command string) string {
+	command = strings.ToUpper(command)
+	if canonical, ok := commandAliases[command]; ok {
+		return canonical
+	}
+
+	return command
+}
+
+func (acl *ACL) allow(addr net.Addr, command string) bool {
+	if acl == nil {
+		return true
+	}
+
+	client := parseClientAddress(addr.String())
+
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	for _, rule := range acl.rules {
+		if command == "" && len(rule.commands) > 0 {
+			continue
+		}
+		if command != "" && !rule.commands[command] {
+			continue
+		}
+
+		if rule.address.match(client) {
+			return rule.allow
+		}
+	}
+
+	return true
+}
+
+// aclAddress matches the addresses of clients
+type aclAddress struct {
+	anyIA bool
+	isd   uint64
+	anyAS bool
+	as    uint64
+	hosts *net.IPNet // Nil for any host
+}
+
+// parseACLAddress parses the address of a rule, see ACL
+func parseACLAddress(s string) (aclAddress, error) {
+	address := aclAddress{anyIA: true, anyAS: true}
+
+	if s == "*" {
+		return address, nil
+	}
+
+	ia, hosts := "", s
+	if i := strings.Index(s, ","); i != -1 {
+		ia, hosts = s[:i], s[i+1:]
+	} else if strings.Contains(s, "-") {
+		ia, hosts = s, ""
+	}
+
+	if ia != "" && ia != "*" {
+		address.anyIA = false
+
+		parts := strings.SplitN(ia, "-", 2)
+		if len(parts) != 2 {
+			return aclAddress{}, fmt.Errorf("invalid ISD-AS %s", ia)
+		}
+
+		var err error
+		address.isd, err = strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return aclAddress{}, fmt.Errorf("invalid ISD-AS %s", ia)
+		}
+
+		if parts[1] != "*" {
+			address.anyAS = false
+			address.as, err = parseAS(parts[1])
+			if err != nil {
+				return aclAddress{}, fmt.Errorf("invalid ISD-AS %s", ia)
+			}
+		}
+	}
+
+	hosts = strings.TrimSuffix(strings.TrimPrefix(hosts, "["), "]")
+	if hosts != "" && hosts != "*" {
+		if !strings.Contains(hosts, "/") {
+			if strings.Contains(hosts, ":") {
+				hosts += "/128"
+			} else {
+				hosts += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(hosts)
+		if err != nil {
+			return aclAddress{}, fmt.Errorf("invalid hosts %s", hosts)
+		}
+		address.hosts = network
+	}
+
+	return address, nil
+}
+
+// parseAS parses an AS number, either decimal or in the form
+// ff00:0:110 with three groups of 16 bits
+func parseAS(s string) (uint64, error) {
+	groups := strings.Split(s, ":")
+	if len(groups) == 1 {
+		return strconv.ParseUint(s, 10, 32)
+	}
+
+	if len(groups) != 3 {
+		return 0, fmt.Errorf("invalid AS %s", s)
+	}
+
+	var as uint64
+	for _, group := range groups {
+		n, err := strconv.ParseUint(group, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid AS %s", s)
+		}
+		as = as<<16 | n
+	}
+
+	return as, nil
+}
+
+// clientAddress is the address of a client, split into its parts
+type clientAddress struct {
+	hasIA bool
+	isd   uint64
+	as    uint64
+	host  net.IP // Nil if the host is not an IP address
+}
+
+// parseClientAddress parses addresses such as "1-ff00:0:110,[10.0.0.1]:4000",
+// addresses of other transports lack the ISD-AS
+func parseClientAddress(s string) clientAddress {
+	var client clientAddress
+
+	if host, _, err := transport.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	if i := strings.Index(s, ","); i != -1 {
+		parts := strings.SplitN(s[:i], "-", 2)
+		if len(parts) == 2 {
+			isd, err1 := strconv.ParseUint(parts[0], 10, 16)
+			as, err2 := parseAS(parts[1])
+			if err1 == nil && err2 == nil {
+				client.hasIA, client.isd, client.as = true, isd, as
+			}
+		}
+		s = s[i+1:]
+	}
+
+	client.host = net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+
+	return client
+}
+
+func (address aclAddress) match(client clientAddress) bool {
+	if !address.anyIA {
+		if !client.hasIA || client.isd != address.isd {
+			return false
+		}
+		if !address.anyAS && client.as != address.as {
+			return false
+		}
+	}
+
+	if address.hosts != nil {
+		return client.host != nil && address.hosts.Contains(client.host)
+	}
+
+	return true
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"testing"
+)
+
+type testAddr string
+
+func (testAddr) Network() string {
+	return "test"
+}
+
+func (addr testAddr) String() string {
+	return string(addr)
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(`
+		# Only our ASes may write
+		allow 1-ff00:0:110 STOR DELE RMD
+		allow 2-*,[10.0.0.0/8] STOR
+		deny * STOR DELE XRMD
+		deny 4-* ERET
+
+		deny 3-*
+		deny 192.168.1.1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var aclTests = []struct {
+		addr    string
+		command string
+		allow   bool
+	}{
+		{"1-ff00:0:110,[127.0.0.1]:4000", "", true},
+		{"1-ff00:0:110,[127.0.0.1]:4000", "STOR", true},
+		{"1-ff00:0:110,[127.0.0.1]:4000", "dele", true},
+		{"1-ff00:0:111,[127.0.0.1]:4000", "STOR", false},
+		{"1-ff00:0:111,[127.0.0.1]:4000", "RETR", true},
+		{"2-ff00:0:210,[10.1.2.3]:4000", "STOR", true},
+		{"2-ff00:0:210,[10.1.2.3]:4000", "DELE", false},
+		{"2-ff00:0:210,[172.16.0.1]:4000", "STOR", false},
+		{"3-ff00:0:310,[127.0.0.1]:4000", "", false},
+		{"192.168.1.1:4000", "", false},
+		{"192.168.1.2:4000", "", true},
+		{"client:4000", "STOR", false},
+		{"client:4000", "LIST", true},
+		{"client:4000", "RMD", false},
+		{"client:4000", "xrmd", false},
+		{"1-ff00:0:110,[127.0.0.1]:4000", "XRMD", true},
+		{"4-ff00:0:410,[127.0.0.1]:4000", "RETR", false},
+		{"4-ff00:0:410,[127.0.0.1]:4000", "ERET", false},
+		{"4-ff00:0:410,[127.0.0.1]:4000", "CKSM", false},
+		{"4-ff00:0:410,[127.0.0.1]:4000", "hash", false},
+		{"4-ff00:0:410,[127.0.0.1]:4000", "LIST", true},
+	}
+
+	for _, tt := range aclTests {
+		t.Run(tt.addr+" "+tt.command, func(t *testing.T) {
+			var allow bool
+			if tt.command == "" {
+				allow = acl.allowSession(testAddr(tt.addr))
+			} else {
+				allow = acl.allowCommand(testAddr(tt.addr), tt.command)
+			}
+
+			if allow != tt.allow {
+				t.Errorf("got %v, want %v", allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	acl, err := NewACL("deny 1-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := testAddr("1-ff00:0:110,[127.0.0.1]:4000")
+	if acl.allowSession(addr) {
+		t.Errorf("expected the session to be denied")
+	}
+
+	if err := acl.Reload("deny 1-ff00:0:111"); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.allowSession(addr) {
+		t.Errorf("expected the session to be allowed after reloading")
+	}
+
+	// Invalid rules keep the previous ones
+	for _, rules := range []string{"block *", "deny", "deny 1-ff00:0", "deny x-*", "allow 10.0.0.0/33"} {
+		if err := acl.Reload(rules); err == nil {
+			t.Errorf("expected an error for %q", rules)
+		}
+	}
+	if !acl.allowSession(addr) || acl.allowSession(testAddr("1-ff00:0:111,[127.0.0.1]:4000")) {
+		t.Errorf("expected the previous rules to be kept")
+	}
+
+	var none *ACL
+	if !none.allowSession(addr) {
+		t.Errorf("expected a nil ACL to allow everyone")
+	}
+}
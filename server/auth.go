@@ -4,6 +4,11 @@
 
 package server
 
+import (
+	"path"
+	"strings"
+)
+
 // Auth is an interface to auth your ftp user login.
 type Auth interface {
 	CheckPasswd(string, string) (bool, error)
@@ -26,3 +31,170 @@ func (a *SimpleAuth) CheckPasswd(name, pass string) (bool, error) {
 	}
 	return true, nil
 }
+
+// Principal describes what a user may do once logged in
+type Principal struct {
+	// The directory the user is confined to, which is the root
+	// directory from the user's point of view. Created at login
+	// if it doesn't exist
+	// Optional, defaults to the root of the driver
+	HomeDir string
+
+	// If true, the user may not change any files
+	ReadOnly bool
+
+	// The maximum total size of the files in the home directory
+	// in bytes, uploads exceeding it are aborted. Uploads to the
+	// same home directory run one after another
+	// Optional, defaults to no limit
+	Quota int64
+
+	// The commands accessing files the user may run, e.g. "RETR" and
+	// "LIST". Other commands, e.g. to set up data connections, are
+	// always available
+	// Optional, defaults to all commands
+	Commands []string
+}
+
+// PrincipalAuth can optionally be implemented by an Auth to give each
+// user its own permissions. Users of a plain Auth share the root
+// directory and may run any command
+type PrincipalAuth interface {
+	Auth
+
+	// Authenticate returns the principal of the user, or nil if the
+	// password is wrong
+	Authenticate(string, string) (*Principal, error)
+}
+
+var (
+	_ PrincipalAuth = MultiAuth{}
+)
+
+// Account is a user of MultiAuth
+type Account struct {
+	Password string
+	Principal
+}
+
+// MultiAuth implements PrincipalAuth with a fixed set of accounts,
+// indexed by user name
+type MultiAuth map[string]Account
+
+// CheckPasswd will check user's password
+func (a MultiAuth) CheckPasswd(name, pass string) (bool, error) {
+	principal, err := a.Authenticate(name, pass)
+	return principal != nil, err
+}
+
+// Authenticate returns the principal of the account
+func (a MultiAuth) Authenticate(name, pass string) (*Principal, error) {
+	account, ok := a[name]
+	if !ok || account.Password != pass {
+		return nil, nil
+	}
+
+	principal := account.Principal
+	return &principal, nil
+}
+
+// sessionCommands don't access files, users may always run them
+var sessionCommands = map[string]bool{
+	"ADAT": true,
+	"ALLO": true,
+	"AUTH": true,
+	"CCC":  true,
+	"CONF": true,
+	"DCAU": true,
+	"ENC":  true,
+	"EPRT": true,
+	"EPSV": true,
+	"FEAT": true,
+	"MIC":  true,
+	"MODE": true,
+	"NOOP": true,
+	"OPTS": true,
+	"PASS": true,
+	"PASV": true,
+	"PBSZ": true,
+	"PORT": true,
+	"PROT": true,
+	"PWD":  true,
+	"QUIT": true,
+	"REST": true,
+	"SBUF": true,
+	"SPAS": true,
+	"SPOR": true,
+	"SSCN": true,
+	"STRU": true,
+	"SYST": true,
+	"TYPE": true,
+	"USER": true,
+	"XPWD": true,
+}
+
+// readCommands access files without changing them. Any other
+// command is assumed to change files
+var readCommands = map[string]bool{
+	"CDUP": true,
+	"CKSM": true,
+	"CWD":  true,
+	"ERET": true,
+	"HASH": true,
+	"LIST": true,
+	"MDTM": true,
+	"NLST": true,
+	"RETR": true,
+	"SIZE": true,
+	"XCUP": true,
+	"XCWD": true,
+}
+
+// allows reports whether the user may run the command, a nil
+// principal may run any
+func (principal *Principal) allows(command string) bool {
+	if principal == nil || sessionCommands[command] {
+		return true
+	}
+
+	if principal.ReadOnly && !readCommands[command] {
+		return false
+	}
+
+	if len(principal.Commands) == 0 {
+		return true
+	}
+
+	for _, allowed := range principal.Commands {
+		if strings.EqualFold(allowed, command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticate checks the password of the user and returns its principal,
+// or nil if the password is wrong
+func (conn *Conn) authenticate(user, pass string) (*Principal, error) {
+	auth, ok := conn.server.Auth.(PrincipalAuth)
+	if !ok {
+		ok, err := conn.server.Auth.CheckPasswd(user, pass)
+		if !ok || err != nil {
+			return nil, err
+		}
+
+		return &Principal{}, nil
+	}
+
+	principal, err := auth.Authenticate(user, pass)
+	if principal == nil || err != nil {
+		return nil, err
+	}
+
+	if principal.HomeDir != "" {
+		principal.HomeDir = path.Clean("/" + principal.HomeDir)
+	}
+
+	return principal, nil
+}
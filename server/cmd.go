@@ -8,11 +8,14 @@ import (
 	"fmt"
 	socket2 "github.com/elwin/transmit/socket"
 	"log"
-	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/elwin/transmit/checksum"
 	"github.com/elwin/transmit/mode"
+	"github.com/elwin/transmit/striping"
+	"github.com/elwin/transmit/transport"
 
 	ftp "github.com/elwin/transmit/client"
 
@@ -40,7 +43,7 @@ var (
 		"CONF": commandConf{},
 		"DELE": commandDele{},
 		"ENC":  commandEnc{},
-		// "EPRT": commandEprt{},
+		"EPRT": commandEprt{},
 		"EPSV": commandEpsv{},
 		"FEAT": commandFeat{},
 		"LIST": commandList{},
@@ -54,7 +57,7 @@ var (
 		"PASS": commandPass{},
 		"PASV": commandPasv{},
 		"PBSZ": commandPbsz{},
-		// "PORT": commandPort{},
+		"PORT": commandPort{},
 		"PROT": commandProt{},
 		"PWD":  commandPwd{},
 		"QUIT": commandQuit{},
@@ -74,7 +77,14 @@ var (
 		"XPWD": commandPwd{},
 		"XRMD": commandRmd{},
 		"SPAS": commandSpas{},
+		"SPOR": commandSpor{},
 		"ERET": commandEret{},
+		"SSCN": commandSscn{},
+		"SBUF": commandNotImplemented{},
+		"DCAU": commandNotImplemented{},
+		"ESTO": commandNotImplemented{},
+		"CKSM": commandCksm{},
+		"HASH": commandHash{},
 	}
 )
 
@@ -139,6 +149,14 @@ func (cmd commandOpts) Execute(conn *Conn, param string) {
 		conn.writeMessage(550, "Unknow params")
 		return
 	}
+	if strings.ToUpper(parts[0]) == "RETR" {
+		conn.optsRetr(parts[1])
+		return
+	}
+	if strings.ToUpper(parts[0]) == "HASH" {
+		conn.optsHash(parts[1])
+		return
+	}
 	if strings.ToUpper(parts[0]) != "UTF8" {
 		conn.writeMessage(550, "Unknow params")
 		return
@@ -151,6 +169,115 @@ func (cmd commandOpts) Execute(conn *Conn, param string) {
 	}
 }
 
+// optsRetr sets the options for subsequent transfers in both directions,
+// given as a list of key=value; pairs. Supported are the GridFTP option
+// Parallelism=<starting>,<minimum>,<maximum>;, Acknowledge=<bool>; which
+// makes the receiver acknowledge segments, see socket.SetAcknowledge, and
+// Checksums=<bool>; which adds a checksum to segments, see socket.SetChecksums
+func (conn *Conn) optsRetr(param string) {
+	for _, option := range strings.Split(param, ";") {
+		if option == "" {
+			continue
+		}
+
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			conn.writeMessage(501, "Unknown option "+option)
+			return
+		}
+
+		switch strings.ToLower(kv[0]) {
+		case "parallelism":
+			if !conn.optsParallelism(kv[1]) {
+				return
+			}
+
+		case "acknowledge":
+			acknowledge, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				conn.writeMessage(501, "Invalid value "+kv[1])
+				return
+			}
+			conn.acknowledge = acknowledge
+
+		case "checksums":
+			checksums, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				conn.writeMessage(501, "Invalid value "+kv[1])
+				return
+			}
+			conn.checksums = checksums
+
+		default:
+			conn.writeMessage(501, "Unknown option "+option)
+			return
+		}
+	}
+
+	message := fmt.Sprintf("Parallelism set to %d", conn.parallelism)
+	if conn.acknowledge {
+		message += ", acknowledging segments"
+	}
+	if conn.checksums {
+		message += ", verifying segments"
+	}
+
+	conn.writeMessage(200, message)
+}
+
+// optsParallelism parses <starting>,<minimum>,<maximum>, replies
+// with an error and returns false if the value is not acceptable
+func (conn *Conn) optsParallelism(value string) bool {
+	var values []int
+	for _, field := range strings.Split(value, ",") {
+		parsed, err := strconv.Atoi(field)
+		if err != nil || parsed < 1 {
+			conn.writeMessage(501, "Invalid parallelism "+value)
+			return false
+		}
+		values = append(values, parsed)
+	}
+
+	if len(values) != 1 && len(values) != 3 {
+		conn.writeMessage(501, "Invalid parallelism "+value)
+		return false
+	}
+
+	parallelism, minimum, maximum := values[0], values[0], values[0]
+	if len(values) == 3 {
+		minimum, maximum = values[1], values[2]
+	}
+
+	if minimum > parallelism || parallelism > maximum {
+		conn.writeMessage(501, "Invalid parallelism "+value)
+		return false
+	}
+
+	if minimum > conn.server.MaxParallelism {
+		conn.writeMessage(501, fmt.Sprintf("Parallelism is limited to %d", conn.server.MaxParallelism))
+		return false
+	}
+
+	if parallelism > conn.server.MaxParallelism {
+		parallelism = conn.server.MaxParallelism
+	}
+
+	conn.parallelism = parallelism
+	return true
+}
+
+// optsHash selects the algorithm of the HASH command
+func (conn *Conn) optsHash(param string) {
+	algorithm, err := checksum.Name(param)
+	if err != nil {
+		conn.writeMessage(504, "Unknown algorithm "+param)
+		return
+	}
+
+	conn.hashAlgorithm = algorithm
+	conn.writeMessage(200, algorithm)
+}
+
 type commandFeat struct{}
 
 func (cmd commandFeat) IsExtend() bool {
@@ -167,7 +294,7 @@ func (cmd commandFeat) RequireAuth() bool {
 
 var (
 	feats    = "Extensions supported:\n%s"
-	featCmds = " UTF8\n"
+	featCmds = " UTF8\n PARALLEL\n ACKNOWLEDGE\n CHECKSUMS\n"
 )
 
 func init() {
@@ -176,6 +303,13 @@ func init() {
 			featCmds = featCmds + " " + k + "\n"
 		}
 	}
+
+	// The selected algorithm is marked with an asterisk
+	featCmds = featCmds + " HASH " + checksum.Algorithms[0] + "*"
+	for _, algorithm := range checksum.Algorithms[1:] {
+		featCmds = featCmds + ";" + algorithm
+	}
+	featCmds = featCmds + "\n"
 }
 
 func (cmd commandFeat) Execute(conn *Conn, param string) {
@@ -221,8 +355,8 @@ func (cmd commandCwd) RequireAuth() bool {
 }
 
 func (cmd commandCwd) Execute(conn *Conn, param string) {
-	path := conn.buildPath(param)
-	err := conn.driver.ChangeDir(path)
+	path := conn.clientPath(param)
+	err := conn.driver.ChangeDir(conn.buildPath(param))
 	if err == nil {
 		conn.namePrefix = path
 		conn.writeMessage(250, "Directory changed to "+path)
@@ -257,12 +391,10 @@ func (cmd commandDele) Execute(conn *Conn, param string) {
 	}
 }
 
-// Only passive socket supported
-//
 // commandEprt responds to the EPRT FTP command. It allows the client to
-// request an active data parallelSockets with more options than the original PORT
-// command. It mainly adds ipv6 support.
-/*
+// request an active data socket with more options than the original PORT
+// command. It mainly adds ipv6 support, the host can be any address the
+// transport understands, e.g. a SCION address.
 type commandEprt struct{}
 
 func (cmd commandEprt) IsExtend() bool {
@@ -278,24 +410,42 @@ func (cmd commandEprt) RequireAuth() bool {
 }
 
 func (cmd commandEprt) Execute(conn *Conn, param string) {
-	delim := string(param[0:1])
+	// |<address family>|<host>|<port>|
+	delim := param[0:1]
 	parts := strings.Split(param, delim)
+	if len(parts) != 5 {
+		conn.writeMessage(501, "Invalid EPRT parameters")
+		return
+	}
+
 	addressFamily, err := strconv.Atoi(parts[1])
-	host := parts[2]
-	port, err := strconv.Atoi(parts[3])
-	if addressFamily != 1 && addressFamily != 2 {
+	if err != nil || (addressFamily != 1 && addressFamily != 2) {
 		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
 		return
 	}
-	socket, err := newActiveSocket(host, port, conn.logger, conn.sessionID)
+
+	port, err := strconv.Atoi(parts[3])
+	if err != nil {
+		conn.writeMessage(501, "Invalid EPRT parameters")
+		return
+	}
+
+	addr := transport.JoinHostPort(parts[2], port)
+	if !conn.allowDataAddrs([]string{addr}) {
+		return
+	}
+
+	conn.closeDataSockets()
+
+	sockets, err := conn.dialDataConns([]string{addr})
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.socket = socket
+
+	conn.socket = sockets[0]
 	conn.writeMessage(200, "connection established ("+strconv.Itoa(port)+")")
 }
-*/
 
 // commandEpsv responds to the EPSV FTP command. It allows the client to
 // request a passive data parallelSockets with more options than the original PASV
@@ -315,11 +465,10 @@ func (cmd commandEpsv) RequireAuth() bool {
 }
 
 func (cmd commandEpsv) Execute(conn *Conn, param string) {
-	port := conn.PassivePort()
-
-	address := conn.server.Hostname + ":" + strconv.Itoa(port)
+	conn.closeDataSockets()
+	protect := conn.protector()
 
-	listener, err := scion.Listen(address)
+	listener, port, err := conn.server.ports.listen(conn.server.Transport, conn.server.Hostname)
 
 	// Connection doesn't get accepted
 	if err != nil {
@@ -330,11 +479,15 @@ func (cmd commandEpsv) Execute(conn *Conn, param string) {
 
 	conn.writeMessage(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
 
-	stream, _ := listener.Accept()
-
-	socket := socket2.NewScionSocket(stream, port)
+	stream, err := acceptBefore(listener, time.Now().Add(conn.server.AcceptTimeout))
+	if err != nil {
+		conn.logger.Printf(conn.sessionID, "Data connection failed: %v", err)
+		listener.Close()
+		return
+	}
 
-	conn.socket = socket
+	// The port is in use until the data connection is closed
+	conn.socket = &passiveSocket{socket2.NewScionSocket(protect(stream), port), listener}
 }
 
 // commandList responds to the LIST FTP command. It allows the client
@@ -379,6 +532,10 @@ func (cmd commandList) Execute(conn *Conn, param string) {
 		files = append(files, info)
 	}
 
+	if !conn.requireDataConn() {
+		return
+	}
+
 	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 
 	conn.sendOutofbandData(listFormatter(files).Detailed())
@@ -438,6 +595,10 @@ func (cmd commandNlst) Execute(conn *Conn, param string) {
 		conn.writeMessage(550, err.Error())
 		return
 	}
+	if !conn.requireDataConn() {
+		return
+	}
+
 	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	conn.sendOutofbandData(listFormatter(files).Short())
 }
@@ -515,19 +676,29 @@ func (cmd commandMode) RequireAuth() bool {
 }
 
 func (cmd commandMode) Execute(conn *Conn, param string) {
-	if strings.ToUpper(param) == "S" {
-		// Stream Mode
-		conn.extendedMode = false
-		conn.writeMessage(200, "OK")
+	// Restart ranges refer to a transfer in the previous mode
+	conn.restartRanges = nil
 
-	} else if strings.ToUpper(param) == "E" {
+	var extended bool
+	switch strings.ToUpper(param) {
+	case "S":
+		// Stream Mode
+		extended = false
+	case "E":
 		// Extended Block Mode
-		conn.extendedMode = true
-		conn.writeMessage(200, "OK")
-
-	} else {
+		extended = true
+	default:
 		conn.writeMessage(504, "MODE is an obsolete command, only (S)tream and (E)xtended Mode supported")
+		return
 	}
+
+	// Data connections set up in the previous mode can't be used
+	if extended != conn.extendedMode {
+		conn.closeDataSockets()
+	}
+
+	conn.extendedMode = extended
+	conn.writeMessage(200, "OK")
 }
 
 // cmdNoop responds to the NOOP FTP command.
@@ -569,19 +740,35 @@ func (cmd commandPass) RequireAuth() bool {
 }
 
 func (cmd commandPass) Execute(conn *Conn, param string) {
-	ok, err := conn.server.Auth.CheckPasswd(conn.reqUser, param)
+	if conn.tlsConfig != nil && !conn.tls {
+		conn.writeMessage(534, "Unsecured login not allowed. AUTH TLS required")
+		return
+	}
+
+	principal, err := conn.authenticate(conn.reqUser, param)
 	if err != nil {
 		conn.writeMessage(550, "Checking password error")
 		return
 	}
 
-	if ok {
-		conn.user = conn.reqUser
-		conn.reqUser = ""
-		conn.writeMessage(230, "Password ok, continue")
-	} else {
+	if principal == nil {
 		conn.writeMessage(530, "Incorrect password, not logged in")
+		return
+	}
+
+	home := principal.HomeDir
+	if home != "" && conn.driver.ChangeDir(home) != nil {
+		if err := conn.driver.MakeDir(home); err != nil {
+			conn.logger.Printf(conn.sessionID, "Home directory %s unavailable: %v", home, err)
+			conn.writeMessage(550, "Home directory unavailable")
+			return
+		}
 	}
+
+	conn.user = conn.reqUser
+	conn.reqUser = ""
+	conn.principal = principal
+	conn.writeMessage(230, "Password ok, continue")
 }
 
 // commandPasv responds to the PASV FTP command.
@@ -607,13 +794,10 @@ func (cmd commandPasv) Execute(conn *Conn, param string) {
 	commandEpsv{}.Execute(conn, param)
 }
 
-// Only passive socket supported
-//
 // commandPort responds to the PORT FTP command.
 //
 // The client has opened a listening socket for sending out of band data and
 // is requesting that we connect to it
-/*
 type commandPort struct{}
 
 func (cmd commandPort) IsExtend() bool {
@@ -628,22 +812,40 @@ func (cmd commandPort) RequireAuth() bool {
 	return true
 }
 
-
 func (cmd commandPort) Execute(conn *Conn, param string) {
+	// h1,h2,h3,h4,p1,p2
 	nums := strings.Split(param, ",")
-	portOne, _ := strconv.Atoi(nums[4])
-	portTwo, _ := strconv.Atoi(nums[5])
+	if len(nums) != 6 {
+		conn.writeMessage(501, "Invalid PORT parameters")
+		return
+	}
+
+	portOne, err1 := strconv.Atoi(nums[4])
+	portTwo, err2 := strconv.Atoi(nums[5])
+	if err1 != nil || err2 != nil {
+		conn.writeMessage(501, "Invalid PORT parameters")
+		return
+	}
+
 	port := (portOne * 256) + portTwo
-	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
-	socket, err := newActiveSocket(host, port, conn.logger, conn.sessionID)
+	host := strings.Join(nums[0:4], ".")
+
+	addr := transport.JoinHostPort(host, port)
+	if !conn.allowDataAddrs([]string{addr}) {
+		return
+	}
+
+	conn.closeDataSockets()
+
+	sockets, err := conn.dialDataConns([]string{addr})
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.socket = socket
+
+	conn.socket = sockets[0]
 	conn.writeMessage(200, "connection established ("+strconv.Itoa(port)+")")
 }
-*/
 
 // commandPwd responds to the PWD FTP command.
 //
@@ -709,17 +911,42 @@ func (cmd commandRetr) Execute(conn *Conn, param string) {
 	defer func() {
 		conn.lastFilePos = 0
 		conn.appendData = false
+		conn.restartRanges = nil
+
+		// Unblocks the client if the transfer failed
+		conn.closeDataSockets()
 	}()
+	// Only extended block mode sends ranges of a file
+	if conn.restartRanges != nil && !conn.extendedMode {
+		conn.writeMessage(503, "Restart ranges require extended block mode")
+		return
+	}
+
+	if driver, ok := conn.driver.(ReaderAtDriver); ok && conn.extendedMode {
+		conn.sendFileAt(driver, path)
+		return
+	}
+
+	if conn.restartRanges != nil {
+		conn.writeMessage(504, "Restarting downloads is not supported")
+		return
+	}
+
 	bytes, data, err := conn.driver.GetFile(path, conn.lastFilePos)
 	if err == nil {
 		defer data.Close()
 
+		if !conn.requireDataConn() {
+			return
+		}
+
 		conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", bytes))
+		conn.startPerfMarkers()
 
 		err = conn.sendOutofBandDataWriter(data)
-
 		if err != nil {
-			conn.writeMessage(551, "Error reading file")
+			conn.stopPerfMarkers()
+			conn.writeTransferError(err)
 		}
 
 	} else {
@@ -743,6 +970,21 @@ func (cmd commandRest) RequireAuth() bool {
 }
 
 func (cmd commandRest) Execute(conn *Conn, param string) {
+
+	// In extended block mode, GridFTP restarts a transfer with
+	// the ranges that have been transferred, see restart markers
+	if conn.extendedMode && strings.Contains(param, "-") {
+		ranges, err := striping.ParseRanges(param)
+		if err != nil {
+			conn.writeMessage(501, "Invalid restart marker")
+			return
+		}
+
+		conn.restartRanges = ranges
+		conn.writeMessage(350, "Restart marker accepted")
+		return
+	}
+
 	var err error
 	conn.lastFilePos, err = strconv.ParseInt(param, 10, 64)
 	if err != nil {
@@ -865,11 +1107,11 @@ func (cmd commandAuth) RequireAuth() bool {
 }
 
 func (cmd commandAuth) Execute(conn *Conn, param string) {
-	if param == "TLS" && conn.tlsConfig != nil {
+	if (param == "TLS" || param == "TLS-C") && conn.tlsConfig != nil && !conn.tls {
 		conn.writeMessage(234, "AUTH command OK")
 		err := conn.upgradeToTLS()
 		if err != nil {
-			conn.logger.Printf("Error upgrading connection to TLS %v", err.Error())
+			conn.logger.Printf(conn.sessionID, "Error upgrading connection to TLS %v", err.Error())
 		}
 	} else {
 		conn.writeMessage(550, "Action not taken")
@@ -946,6 +1188,7 @@ func (cmd commandPbsz) RequireAuth() bool {
 
 func (cmd commandPbsz) Execute(conn *Conn, param string) {
 	if conn.tls && param == "0" {
+		conn.bufferSizeSet = true
 		conn.writeMessage(200, "OK")
 	} else {
 		conn.writeMessage(550, "Action not taken")
@@ -966,14 +1209,38 @@ func (cmd commandProt) RequireAuth() bool {
 	return false
 }
 
+// Execute sets the protection level of the data connections set up
+// afterwards. TLS only provides the levels C and P (RFC 4217), levels
+// below the minimum of the server are refused
 func (cmd commandProt) Execute(conn *Conn, param string) {
-	if conn.tls && param == "P" {
-		conn.writeMessage(200, "OK")
-	} else if conn.tls {
-		conn.writeMessage(536, "Only P level is supported")
-	} else {
+	if !conn.tls {
 		conn.writeMessage(550, "Action not taken")
+		return
 	}
+
+	if !conn.bufferSizeSet {
+		conn.writeMessage(503, "PBSZ required")
+		return
+	}
+
+	level, err := parseProtectionLevel(param)
+	if err != nil {
+		conn.writeMessage(504, "Unknown protection level")
+		return
+	}
+
+	if level == protectionSafe || level == protectionConfidential {
+		conn.writeMessage(536, "Only C and P levels are supported")
+		return
+	}
+
+	if level < conn.server.minProtection {
+		conn.writeMessage(534, "Protection level "+conn.server.minProtection.String()+" required")
+		return
+	}
+
+	conn.protection = level
+	conn.writeMessage(200, "Protection level set to "+level.String())
 }
 
 type commandConf struct{}
@@ -1015,7 +1282,7 @@ func (cmd commandSize) Execute(conn *Conn, param string) {
 	stat, err := conn.driver.Stat(path)
 	if err != nil {
 		log.Printf("Size: error(%s)", err)
-		conn.writeMessage(450, fmt.Sprint("path", path, "not found"))
+		conn.writeMessage(450, fmt.Sprint("path", conn.clientPath(param), "not found"))
 	} else {
 		conn.writeMessage(213, strconv.Itoa(int(stat.Size())))
 	}
@@ -1039,15 +1306,49 @@ func (cmd commandStor) RequireAuth() bool {
 
 func (cmd commandStor) Execute(conn *Conn, param string) {
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
 
 	defer func() {
 		conn.appendData = false
+		conn.restartRanges = nil
+
+		// The data connection serves a single upload
+		conn.closeDataSockets()
 	}()
 
-	bytes, err := conn.driver.PutFile(targetPath, conn.getActiveSocket(), conn.appendData)
+	if _, ok := conn.driver.(WriterAtDriver); conn.restartRanges != nil && !ok {
+		conn.writeMessage(504, "Restarting uploads is not supported")
+		return
+	}
 
-	if err == nil {
+	if !conn.requireDataConn() {
+		return
+	}
+
+	q, err := conn.uploadQuota(targetPath)
+	if err != nil {
+		conn.writeMessage(451, fmt.Sprint("Checking quota failed: ", err))
+		return
+	}
+	defer q.release()
+
+	conn.writeMessage(150, "Data transfer starting")
+	conn.startPerfMarkers()
+
+	var bytes int64
+	if conn.extendedMode {
+		bytes, err = conn.receiveStriped(targetPath, q)
+	} else {
+		bytes, err = conn.driver.PutFile(targetPath, q.reader(conn.getActiveSocket()), conn.appendData)
+	}
+	conn.stopPerfMarkers()
+
+	if q.wasExceeded() {
+		// Nothing worth keeping of a new upload
+		if !conn.appendData && conn.restartRanges == nil {
+			conn.driver.DeleteFile(targetPath)
+		}
+		conn.writeMessage(552, "Exceeded storage allocation")
+	} else if err == nil {
 		msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
 		conn.writeMessage(226, msg)
 	} else {
@@ -1155,8 +1456,8 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *Conn, param string) {
-	conn.reqUser = param
 	if conn.tls || conn.tlsConfig == nil {
+		conn.reqUser = param
 		conn.writeMessage(331, "User name ok, password required")
 	} else {
 		conn.writeMessage(534, "Unsecured login not allowed. AUTH TLS required")
@@ -1186,49 +1487,211 @@ func (cmd commandSpas) RequireAuth() bool {
 }
 
 func (cmd commandSpas) Execute(conn *Conn, param string) {
-
-	ports := make([]int, 4)
-	for i := range ports {
-		ports[i] = rand.Intn(1000) + 40000
+	if !conn.extendedMode {
+		conn.writeMessage(503, "Striped transfers require extended block mode")
+		return
 	}
 
+	conn.closeDataSockets()
+	protect := conn.protector()
+
+	ports := make([]int, conn.parallelism)
+
 	var listeners []scion.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
 
 	line := "Entering Striped Passive Mode\n"
 
-	for _, port := range ports {
-
-		address := conn.server.Hostname + ":" + strconv.Itoa(port)
+	for i := range ports {
 
-		listener, err := scion.Listen(address)
+		listener, port, err := conn.server.ports.listen(conn.server.Transport, conn.server.Hostname)
 		if err != nil {
+			closeListeners()
 			conn.writeMessage(425, "Data connection failed")
 			return
 		}
 
-		line += " " + address + "\r\n"
+		ports[i] = port
+		line += " " + transport.JoinStripe(conn.server.Hostname, port) + "\r\n"
 
 		listeners = append(listeners, listener)
 	}
 
 	conn.writeMessageMultiline(229, line)
 
+	// The client chooses a distinct path for each stream,
+	// replies follow the reversed path of the incoming stream
 	sockets := make([]socket2.DataSocket, len(listeners))
 
+	// The 229 reply has been sent already, without data connection
+	// the next transfer is answered with 425 instead
+	deadline := time.Now().Add(conn.server.AcceptTimeout)
 	for i, listener := range listeners {
-		stream, err := listener.Accept()
+		stream, err := acceptBefore(listener, deadline)
+		if err != nil {
+			conn.logger.Printf(conn.sessionID, "Data connection failed: %v", err)
+			for _, socket := range sockets[:i] {
+				socket.Close()
+			}
+			closeListeners()
+			return
+		}
+
+		sockets[i] = socket2.NewScionSocket(protect(stream), ports[i])
+	}
+
+	conn.parallelSockets = conn.newStripedSocket(sockets)
+
+	// The client might replace failed streams during the transfer
+	conn.parallelSockets.SetAccept(acceptOnAny(listeners, ports, protect))
+}
+
+// commandSpor responds to the SPOR FTP command, the active counterpart
+// of SPAS. The parameters are the addresses the client listens on, or
+// another server listed in its reply to SPAS. We connect to each of them
+// to transfer in extended block mode, e.g. "SPOR h1,h2,h3,h4,p1,p2 ...",
+// see transport.JoinStripe
+type commandSpor struct{}
+
+func (cmd commandSpor) IsExtend() bool {
+	return true
+}
+
+func (cmd commandSpor) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSpor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSpor) Execute(conn *Conn, param string) {
+	if !conn.extendedMode {
+		conn.writeMessage(503, "Striped transfers require extended block mode")
+		return
+	}
+
+	stripes := strings.Fields(param)
+	if len(stripes) > conn.server.MaxParallelism {
+		conn.writeMessage(501, fmt.Sprintf("At most %d ports are supported", conn.server.MaxParallelism))
+		return
+	}
+
+	addrs := make([]string, len(stripes))
+	for i, stripe := range stripes {
+		host, port, err := transport.SplitStripe(stripe)
 		if err != nil {
-			conn.writeMessage(400, "Data connection failed")
+			conn.writeMessage(501, "Invalid SPOR parameters")
 			return
 		}
+		addrs[i] = transport.JoinHostPort(host, port)
+	}
 
-		sockets[i] = socket2.NewScionSocket(stream, ports[i])
+	if !conn.allowDataAddrs(addrs) {
+		return
 	}
 
-	conn.parallelSockets = socket2.NewMultiSocket(sockets, conn.server.MaxChunkLength)
+	conn.closeDataSockets()
+
+	sockets, err := conn.dialDataConns(addrs)
+	if err != nil {
+		conn.writeMessage(425, "Data connection failed")
+		return
+	}
 
+	conn.parallelSockets = conn.newStripedSocket(sockets)
+	conn.writeMessage(200, fmt.Sprintf("Connected to %d ports", len(sockets)))
 }
 
+// acceptBefore accepts a connection on listener, unless none arrives
+// before the deadline. The listener is closed in that case
+func acceptBefore(listener scion.Listener, deadline time.Time) (scion.Conn, error) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		listener.Close()
+	})
+
+	stream, err := listener.Accept()
+
+	// The listener might have been closed right after accepting
+	if !timer.Stop() {
+		if err == nil {
+			stream.Close()
+		}
+		return nil, fmt.Errorf("no connection before %s", deadline.Format(time.RFC3339))
+	}
+
+	return stream, err
+}
+
+// newStripedSocket sends and receives in extended block mode
+// over the sockets, configured as negotiated with the client
+func (conn *Conn) newStripedSocket(sockets []socket2.DataSocket) *socket2.MultiSocket {
+	striped := socket2.NewMultiSocket(sockets, conn.server.MaxChunkLength)
+	striped.SetAdaptive(socket2.Adaptive{
+		MinChunkLength: conn.server.MinChunkLength,
+		MaxChunkLength: conn.server.MaxChunkLength,
+		AdaptStreams:   conn.server.AdaptiveStreams,
+	})
+	striped.SetScheduler(conn.server.Scheduler)
+	striped.SetBufferSize(conn.server.ReceiveBufferSize)
+	striped.SetAcknowledge(conn.acknowledge)
+	striped.SetChecksums(conn.checksums)
+
+	return striped
+}
+
+// acceptOnAny accepts connections on all listeners until stop is called,
+// which closes the listeners. Connections are secured by protect
+func acceptOnAny(listeners []scion.Listener, ports []int, protect func(scion.Conn) scion.Conn) (accept func() (socket2.DataSocket, error), stop func()) {
+	sockets := make(chan socket2.DataSocket)
+	stopped := make(chan struct{})
+
+	for i := range listeners {
+		go func(listener scion.Listener, port int) {
+			for {
+				stream, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				select {
+				case sockets <- socket2.NewScionSocket(protect(stream), port):
+				case <-stopped:
+					stream.Close()
+					return
+				}
+			}
+		}(listeners[i], ports[i])
+	}
+
+	accept = func() (socket2.DataSocket, error) {
+		select {
+		case socket := <-sockets:
+			return socket, nil
+		case <-stopped:
+			return nil, fmt.Errorf("stopped accepting connections")
+		}
+	}
+
+	stop = func() {
+		close(stopped)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	return accept, stop
+
+}
+
+// commandEret responds to the GridFTP ERET command.
+//
+// It retrieves part of a file, a preceding REST skips
+// the first bytes of the part.
 type commandEret struct{}
 
 func (commandEret) IsExtend() bool {
@@ -1243,47 +1706,263 @@ func (commandEret) RequireAuth() bool {
 	return true
 }
 
-// TODO: Handle conn.lastFilePos yet
 func (commandEret) Execute(conn *Conn, param string) {
+	defer func() {
+		conn.lastFilePos = 0
+		conn.appendData = false
+		conn.restartRanges = nil
+
+		// Unblocks the client if the transfer failed
+		conn.closeDataSockets()
+	}()
 
-	params := strings.Split(param, " ")
-	module := strings.Split(params[0], "=")
-	moduleName := module[0]
-	moduleParams := strings.Split(strings.Trim(module[1], "\""), ",")
-	offset, err := strconv.Atoi(moduleParams[0])
+	moduleName, offset, length, path, err := parseEret(param)
 	if err != nil {
 		conn.writeMessage(501, "Failed to parse parameters")
 		return
 	}
-	length, err := strconv.Atoi(moduleParams[1])
+
+	if moduleName != mode.PartialFileTransport {
+		conn.writeMessage(ftp.StatusNotImplemented, "Only PFT supported")
+		return
+	}
+
+	skip := conn.lastFilePos
+	if skip > length {
+		skip = length
+	}
+
+	bytes, data, err := conn.driver.GetFile(conn.buildPath(path), offset+skip)
 	if err != nil {
-		conn.writeMessage(501, "Failed to parse parameters")
+		conn.writeMessage(551, "File not available")
 		return
 	}
-	path := conn.buildPath(params[1])
+	defer data.Close()
 
-	if moduleName == mode.PartialFileTransport {
+	length -= skip
+	if length > bytes {
+		length = bytes
+	}
 
-		bytes, data, err := conn.driver.GetFile(path, int64(offset))
-		if err != nil {
-			conn.writeMessage(551, "File not available")
-			return
-		}
-		defer data.Close()
+	if !conn.requireDataConn() {
+		return
+	}
 
-		conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", bytes))
+	conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", length))
+	conn.startPerfMarkers()
 
-		err = conn.sendDataOverSocketN(data, conn.socket, length)
+	err = conn.sendDataOverSocketN(data, conn.getActiveSocket(), int(length))
+	if err == nil {
+		err = conn.closeActiveSocket()
+	}
 
-		conn.socket.Close()
-		conn.socket = nil
+	if err != nil {
+		conn.stopPerfMarkers()
+		conn.writeTransferError(err)
+	}
+}
 
-		if err != nil {
-			conn.writeMessage(551, "Error reading file")
+// parseEret parses the parameters of ERET, either PFT="offset,length" path
+// or P offset length path, as the partial file transfer is named in GFD.020
+func parseEret(param string) (moduleName string, offset, length int64, path string, err error) {
+	var moduleParams []string
+
+	if strings.HasPrefix(param, "P ") {
+		fields := strings.SplitN(param, " ", 4)
+		if len(fields) != 4 {
+			return "", 0, 0, "", fmt.Errorf("missing parameters")
 		}
 
+		moduleName = mode.PartialFileTransport
+		moduleParams = fields[1:3]
+		path = fields[3]
 	} else {
-		conn.writeMessage(ftp.StatusNotImplemented, "Only PFT supported")
+		params := strings.SplitN(param, " ", 2)
+		module := strings.SplitN(params[0], "=", 2)
+		if len(params) != 2 || len(module) != 2 {
+			return "", 0, 0, "", fmt.Errorf("missing parameters")
+		}
+
+		moduleName = module[0]
+		moduleParams = strings.Split(strings.Trim(module[1], "\""), ",")
+		path = params[1]
+	}
+
+	if len(moduleParams) != 2 {
+		return "", 0, 0, "", fmt.Errorf("expected offset and length")
+	}
+
+	offset, err = strconv.ParseInt(moduleParams[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	length, err = strconv.ParseInt(moduleParams[1], 10, 64)
+	if err != nil {
+		return
+	}
+
+	if offset < 0 || length < 0 {
+		err = fmt.Errorf("negative offset or length")
+	}
+
+	return
+}
+
+// commandSscn responds to the GridFTP SSCN command.
+//
+// SSCN ON makes the server take the role of the TLS client on protected
+// data connections, SSCN OFF the role of the TLS server again. Without
+// parameter, it replies with the current role. This lets two servers
+// protect the data connection of a third-party transfer.
+type commandSscn struct{}
+
+func (commandSscn) IsExtend() bool {
+	return true
+}
+
+func (commandSscn) RequireParam() bool {
+	return false
+}
+
+func (commandSscn) RequireAuth() bool {
+	return true
+}
+
+func (commandSscn) Execute(conn *Conn, param string) {
+	switch strings.ToUpper(param) {
+	case "ON":
+		conn.tlsClient = true
+	case "OFF":
+		conn.tlsClient = false
+	case "":
+	default:
+		conn.writeMessage(501, "Invalid SSCN parameter, use ON or OFF")
+		return
+	}
+
+	if conn.tlsClient {
+		conn.writeMessage(200, "Client mode")
+	} else {
+		conn.writeMessage(200, "Server mode")
+	}
+}
+
+// commandNotImplemented responds to GridFTP commands that are not
+// supported, which FEAT doesn't list either.
+//
+// SBUF sets the TCP buffer size of the data connections, which doesn't
+// apply to SCION. DCAU selects the authentication of data connections,
+// which requires GSI. ESTO stores data at offsets given by a module.
+type commandNotImplemented struct{}
+
+func (commandNotImplemented) IsExtend() bool {
+	return false
+}
+
+func (commandNotImplemented) RequireParam() bool {
+	return false
+}
+
+func (commandNotImplemented) RequireAuth() bool {
+	return false
+}
+
+func (commandNotImplemented) Execute(conn *Conn, param string) {
+	conn.writeMessage(502, "Command not implemented")
+}
+
+// commandCksm responds to the GridFTP CKSM command.
+//
+// It returns the hash of a part of a file, given as
+// CKSM <algorithm> <offset> <length> <path>, where
+// a length of -1 refers to the rest of the file.
+type commandCksm struct{}
+
+func (commandCksm) IsExtend() bool {
+	return true
+}
+
+func (commandCksm) RequireParam() bool {
+	return true
+}
+
+func (commandCksm) RequireAuth() bool {
+	return true
+}
+
+func (commandCksm) Execute(conn *Conn, param string) {
+	params := strings.SplitN(param, " ", 4)
+	if len(params) != 4 {
+		conn.writeMessage(501, "Failed to parse parameters")
+		return
+	}
+
+	algorithm, err := checksum.Name(params[0])
+	if err != nil {
+		conn.writeMessage(504, "Unknown algorithm "+params[0])
+		return
+	}
+
+	offset, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil || offset < 0 {
+		conn.writeMessage(501, "Invalid offset "+params[1])
+		return
+	}
+
+	length, err := strconv.ParseInt(params[2], 10, 64)
+	if err != nil || length < -1 {
+		conn.writeMessage(501, "Invalid length "+params[2])
+		return
+	}
+
+	hash, err := conn.fileHash(conn.buildPath(params[3]), algorithm, offset, length)
+	if err != nil {
+		conn.writeMessage(550, fmt.Sprint("error computing checksum: ", err))
+		return
+	}
+
+	conn.writeMessage(213, hash)
+}
+
+// commandHash responds to the HASH command of draft-bryan-ftp-hash.
+//
+// It returns the hash of a file with the algorithm selected by OPTS HASH,
+// along with the range it covers, which is always the whole file.
+type commandHash struct{}
+
+func (commandHash) IsExtend() bool {
+	return false
+}
+
+func (commandHash) RequireParam() bool {
+	return true
+}
+
+func (commandHash) RequireAuth() bool {
+	return true
+}
+
+func (commandHash) Execute(conn *Conn, param string) {
+	path := conn.buildPath(param)
+	stat, err := conn.driver.Stat(path)
+	if err != nil {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+
+	hash, err := conn.fileHash(path, conn.hashAlgorithm, 0, -1)
+	if err != nil {
+		conn.writeMessage(550, fmt.Sprint("error computing hash: ", err))
+		return
+	}
+
+	// The range includes its end, an empty file has the empty range 1-0,
+	// which is how draft-bryan-ftp-range writes a range without bytes
+	byteRange := fmt.Sprintf("0-%d", stat.Size()-1)
+	if stat.Size() == 0 {
+		byteRange = "1-0"
 	}
 
+	conn.writeMessage(213, fmt.Sprintf("%s %s %s %s", conn.hashAlgorithm, byteRange, hash, param))
 }
@@ -12,12 +12,18 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	random "math/rand"
+	"net"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/elwin/transmit/checksum"
 	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/striping"
+	"github.com/elwin/transmit/transport"
 
 	"github.com/elwin/transmit/scion"
 )
@@ -30,6 +36,7 @@ type Conn struct {
 	conn            scion.Conn
 	controlReader   *bufio.Reader
 	controlWriter   *bufio.Writer
+	controlMu       sync.Mutex // Markers are sent during transfers
 	socket          socket.DataSocket
 	parallelSockets *socket.MultiSocket
 	driver          Driver
@@ -41,18 +48,34 @@ type Conn struct {
 	namePrefix      string
 	reqUser         string
 	user            string
+	principal       *Principal // Set at login
 	renameFrom      string
 	lastFilePos     int64
 	appendData      bool
+	restartRanges   striping.Ranges // Set by REST in extended block mode
 	closed          bool
 	tls             bool
+	bufferSizeSet   bool            // PBSZ, which has to precede PROT
+	protection      protectionLevel // Set by PROT
+	dataProtection  protectionLevel // Of the data connections set up
+	tlsClient       bool            // Role on data connections, see SSCN
 	extendedMode    bool
+	parallelism     int
+	acknowledge     bool
+	checksums       bool
+	hashAlgorithm   string // Selected by OPTS HASH
+	perfMarkers     func() // Stops sending performance markers
 }
 
 func (conn *Conn) LoginUser() string {
 	return conn.user
 }
 
+// Principal returns the permissions of the logged in user
+func (conn *Conn) Principal() *Principal {
+	return conn.principal
+}
+
 func (conn *Conn) IsLogin() bool {
 	return len(conn.user) > 0
 }
@@ -65,13 +88,8 @@ func (conn *Conn) passiveListenIP() string {
 	if len(conn.PublicIp()) > 0 {
 		return conn.PublicIp()
 	}
-	return conn.conn.LocalAddr().Host.String()
-}
-
-// TODO: Replace generation with proper function
-func (conn *Conn) PassivePort() int {
-
-	return random.Intn(10000) + 40000
+	host, _, _ := transport.SplitHostPort(conn.conn.LocalAddr().String())
+	return host
 }
 
 // returns a random 20 char string that can be used as a unique session ID
@@ -93,6 +111,12 @@ func newSessionID() string {
 // cleaned up.
 func (conn *Conn) Serve() {
 	conn.logger.Print(conn.sessionID, "connection Established")
+	if !conn.server.ACL.allowSession(conn.conn.RemoteAddr()) {
+		conn.logger.Printf(conn.sessionID, "Access denied to %s", conn.conn.RemoteAddr())
+		conn.writeMessage(421, "Access denied")
+		conn.Close()
+		return
+	}
 	// send welcome
 	conn.writeMessage(220, conn.server.WelcomeMessage)
 	// read commands
@@ -120,6 +144,12 @@ func (conn *Conn) Serve() {
 func (conn *Conn) Close() {
 	conn.conn.Close()
 	conn.closed = true
+	conn.closeDataSockets()
+}
+
+// closeDataSockets closes the data connections that have been set up
+// but not used for a transfer, which frees their passive ports
+func (conn *Conn) closeDataSockets() {
 	if conn.socket != nil {
 		conn.socket.Close()
 		conn.socket = nil
@@ -132,21 +162,16 @@ func (conn *Conn) Close() {
 }
 
 func (conn *Conn) upgradeToTLS() error {
-
-	return nil
-	/*
-
-		conn.logger.Print(conn.sessionID, "Upgrading connectiion to TLS")
-		tlsConn := tls.Server(conn.conn, conn.tlsConfig)
-		err := tlsConn.Handshake()
-		if err == nil {
-			conn.conn = tlsConn
-			conn.controlReader = bufio.NewReader(tlsConn)
-			conn.controlWriter = bufio.NewWriter(tlsConn)
-			conn.tls = true
-		}
-		return err
-	*/
+	conn.logger.Print(conn.sessionID, "Upgrading connection to TLS")
+	tlsConn := transport.TLSServer(conn.conn, conn.tlsConfig)
+	err := tlsConn.Handshake()
+	if err == nil {
+		conn.conn = tlsConn
+		conn.controlReader = bufio.NewReader(tlsConn)
+		conn.controlWriter = bufio.NewWriter(tlsConn)
+		conn.tls = true
+	}
+	return err
 }
 
 // receiveLine accepts a single line FTP command and co-ordinates an
@@ -159,10 +184,22 @@ func (conn *Conn) receiveLine(line string) {
 		conn.writeMessage(500, "Command not found")
 		return
 	}
+	// The rules might have been reloaded since the session started
+	if !conn.server.ACL.allowSession(conn.conn.RemoteAddr()) {
+		conn.writeMessage(421, "Access denied")
+		conn.Close()
+		return
+	}
+	if !conn.server.ACL.allowCommand(conn.conn.RemoteAddr(), command) {
+		conn.writeMessage(550, "Permission denied")
+		return
+	}
 	if cmdObj.RequireParam() && param == "" {
 		conn.writeMessage(553, "action aborted, required param missing")
 	} else if cmdObj.RequireAuth() && conn.user == "" {
 		conn.writeMessage(530, "not logged in")
+	} else if cmdObj.RequireAuth() && !conn.principal.allows(strings.ToUpper(command)) {
+		conn.writeMessage(550, "Permission denied")
 	} else {
 		cmdObj.Execute(conn, param)
 	}
@@ -178,6 +215,9 @@ func (conn *Conn) parseLine(line string) (string, string) {
 
 // writeMessage will send a standard FTP response back to the client.
 func (conn *Conn) writeMessage(code int, message string) (wrote int, err error) {
+	conn.controlMu.Lock()
+	defer conn.controlMu.Unlock()
+
 	conn.logger.PrintResponse(conn.sessionID, code, message)
 	line := fmt.Sprintf("%d %s\r\n", code, message)
 	wrote, err = conn.controlWriter.WriteString(line)
@@ -187,6 +227,9 @@ func (conn *Conn) writeMessage(code int, message string) (wrote int, err error)
 
 // writeMessage will send a standard FTP response back to the client.
 func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, err error) {
+	conn.controlMu.Lock()
+	defer conn.controlMu.Unlock()
+
 	conn.logger.PrintResponse(conn.sessionID, code, message)
 	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
 	wrote, err = conn.controlWriter.WriteString(line)
@@ -194,7 +237,7 @@ func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, er
 	return
 }
 
-// buildPath takes a client supplied path or filename and generates a safe
+// clientPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
 //    buildpath("/")
@@ -211,7 +254,7 @@ func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, er
 // The driver implementation is responsible for deciding how to treat this path.
 // Obviously they MUST NOT just read the path off disk. The probably want to
 // prefix the path with something to scope the users access to a sandbox.
-func (conn *Conn) buildPath(filename string) (fullPath string) {
+func (conn *Conn) clientPath(filename string) (fullPath string) {
 	if len(filename) > 0 && filename[0:1] == "/" {
 		fullPath = filepath.Clean(filename)
 	} else if len(filename) > 0 && filename != "-a" {
@@ -224,6 +267,17 @@ func (conn *Conn) buildPath(filename string) (fullPath string) {
 	return
 }
 
+// buildPath returns the path passed to the driver for a client supplied
+// path, see clientPath, which is within the home directory of the user
+func (conn *Conn) buildPath(filename string) string {
+	fullPath := conn.clientPath(filename)
+	if conn.principal == nil || conn.principal.HomeDir == "" {
+		return fullPath
+	}
+
+	return path.Join(conn.principal.HomeDir, fullPath)
+}
+
 // sendOutofbandData will send a string to the client via the currently open
 // data parallelSockets. Assumes the parallelSockets is open and ready to be used.
 func (conn *Conn) sendOutofbandData(data []byte) {
@@ -245,14 +299,20 @@ func (conn *Conn) sendOutofBandDataWriter(data io.ReadCloser) error {
 		return err
 	}
 
-	conn.closeActiveSocket()
-
-	return nil
+	return conn.closeActiveSocket()
 }
 
 func (conn *Conn) sendDataOverSocket(data io.Reader, socket socket.DataSocket) error {
 
-	bytes, err := io.Copy(socket, data)
+	// Striped sockets read files with positional reads on all streams,
+	// io.Copy would prefer the WriterTo of *os.File
+	var bytes int64
+	var err error
+	if readerFrom, ok := socket.(io.ReaderFrom); ok {
+		bytes, err = readerFrom.ReadFrom(data)
+	} else {
+		bytes, err = io.Copy(socket, data)
+	}
 
 	if err != nil {
 		return err
@@ -272,14 +332,356 @@ func (conn *Conn) sendDataOverSocketN(data io.Reader, socket socket.DataSocket,
 	}
 
 	message := "Successfully sent " + strconv.Itoa(int(bytes)) + " bytes"
-	conn.writeMessage(200, message)
+	conn.logger.Print(conn.sessionID, message)
 
 	return nil
 }
 
+// sendFileAt sends a file in extended block mode, each stream reads the
+// segments it sends from the file. If the download is resumed, only the
+// parts of the file that are not covered by the restart ranges are sent
+func (conn *Conn) sendFileAt(driver ReaderAtDriver, path string) {
+	file, size, err := driver.OpenReader(path)
+	if err != nil {
+		conn.writeMessage(551, "File not available")
+		return
+	}
+	defer file.Close()
+
+	if !conn.requireDataConn() {
+		return
+	}
+
+	offset := conn.lastFilePos
+	if offset > size {
+		offset = size
+	}
+
+	conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", size-offset))
+	conn.startPerfMarkers()
+
+	err = conn.sendRanges(file, offset, size)
+	if err != nil {
+		conn.stopPerfMarkers()
+		conn.writeTransferError(err)
+	}
+}
+
+// sendRanges sends the file from offset, or the
+// ranges that are missing from the restart ranges
+func (conn *Conn) sendRanges(file io.ReaderAt, offset, size int64) error {
+	conn.getActiveSocket()
+	defer func() {
+		// After a failure, closeActiveSocket isn't reached
+		if conn.parallelSockets != nil {
+			conn.parallelSockets.Close()
+			conn.parallelSockets = nil
+		}
+	}()
+
+	var bytes int64
+	var err error
+	if conn.restartRanges != nil {
+		missing := conn.restartRanges.Missing(0, uint64(size))
+		bytes, err = conn.parallelSockets.CopyRanges(file, missing)
+	} else {
+		bytes, err = conn.parallelSockets.CopyFrom(file, offset, size-offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	message := "Successfully sent " + strconv.Itoa(int(bytes)) + " bytes"
+	conn.logger.Print(conn.sessionID, message)
+
+	return conn.closeActiveSocket()
+}
+
+// receiveStriped receives an upload in extended block mode. If the driver
+// writes at offsets, segments are written as they arrive and an upload can
+// be resumed with the restart ranges, otherwise the data is passed to the
+// driver in order. Either way, the client is informed about the ranges
+// received in restart markers
+func (conn *Conn) receiveStriped(path string, q *quota) (int64, error) {
+	conn.getActiveSocket()
+	striped := conn.parallelSockets
+
+	// The streams can't be used for another transfer,
+	// closing also stops accepting replacements
+	defer func() {
+		striped.Close()
+		conn.parallelSockets = nil
+	}()
+
+	stop := conn.sendRangeMarkers(striped)
+	defer stop()
+
+	// Appending refers to the end of the file rather than to offsets
+	driver, ok := conn.driver.(WriterAtDriver)
+	if !ok || conn.appendData {
+		return conn.driver.PutFile(path, q.reader(striped), conn.appendData)
+	}
+
+	file, err := driver.OpenFile(path, conn.restartRanges != nil)
+	if err != nil {
+		return 0, err
+	}
+	file = q.writerAt(file)
+
+	striped.Resume(conn.restartRanges)
+	bytes, err := striped.CopyTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return bytes, err
+}
+
+// sendRangeMarkers periodically sends a restart marker with the ranges
+// received so far, until stop is called
+func (conn *Conn) sendRangeMarkers(striped *socket.MultiSocket) (stop func()) {
+	var last string
+
+	return every(conn.server.MarkerInterval, func() {
+		ranges := striped.Received().String()
+		if ranges != "" && ranges != last {
+			conn.writeMessage(111, "Range Marker "+ranges)
+			last = ranges
+		}
+	})
+}
+
+// startPerfMarkers periodically sends a performance marker for each stream
+// of a transfer in extended block mode, until stopPerfMarkers is called
+func (conn *Conn) startPerfMarkers() {
+	if !conn.extendedMode {
+		return
+	}
+
+	conn.getActiveSocket()
+	striped := conn.parallelSockets
+	if striped == nil {
+		return
+	}
+
+	stop := every(conn.server.PerfInterval, func() {
+		conn.sendPerfMarkers(striped)
+	})
+
+	conn.perfMarkers = func() {
+		stop()
+
+		// The final counts of the transfer
+		conn.sendPerfMarkers(striped)
+	}
+}
+
+// stopPerfMarkers has to be called before the reply that concludes
+// the transfer, markers must not follow it
+func (conn *Conn) stopPerfMarkers() {
+	if conn.perfMarkers != nil {
+		conn.perfMarkers()
+		conn.perfMarkers = nil
+	}
+}
+
+// sendPerfMarkers reports the bytes transferred over each stream as in
+// GridFTP, where each stripe sends its own marker
+func (conn *Conn) sendPerfMarkers(striped *socket.MultiSocket) {
+	transferred := striped.Transferred()
+	timestamp := float64(time.Now().UnixNano()) / float64(time.Second)
+
+	for i, bytes := range transferred {
+		lines := []string{
+			"Perf Marker",
+			fmt.Sprintf(" Timestamp: %.1f", timestamp),
+			fmt.Sprintf(" Stripe Index: %d", i),
+			fmt.Sprintf(" Stripe Bytes Transferred: %d", bytes),
+			fmt.Sprintf(" Total Stripe Count: %d", len(transferred)),
+		}
+		conn.writeMessageMultiline(112, strings.Join(lines, "\r\n"))
+	}
+}
+
+// every calls f periodically until stop is called
+func every(interval time.Duration, f func()) (stop func()) {
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+// fileHash returns the hash of length bytes of the file, starting at offset.
+// A length of -1 refers to the rest of the file. Hashes stored by the driver
+// are preferred, see HashDriver
+func (conn *Conn) fileHash(path, algorithm string, offset, length int64) (string, error) {
+	if driver, ok := conn.driver.(HashDriver); ok {
+		hash, err := driver.Hash(path, algorithm, offset, length)
+		if err != nil || hash != "" {
+			return hash, err
+		}
+	}
+
+	_, data, err := conn.driver.GetFile(path, offset)
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	var r io.Reader = data
+	if length >= 0 {
+		r = io.LimitReader(data, length)
+	}
+
+	return checksum.Sum(algorithm, r)
+}
+
+// allowDataAddrs reports whether the server may connect to the addresses
+// requested by PORT, EPRT or SPOR, which have to be on the client's host
+// unless they are listed in ServerOpts.ThirdPartyHosts. Otherwise clients
+// could make the server connect anywhere on their behalf (FTP bounce)
+func (conn *Conn) allowDataAddrs(addrs []string) bool {
+	client := conn.conn.RemoteAddr().String()
+	if host, _, err := transport.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	for _, addr := range addrs {
+		host, _, err := transport.SplitHostPort(addr)
+		if err != nil || !conn.allowDataHost(canonicalHost(host), canonicalHost(client)) {
+			conn.logger.Printf(conn.sessionID, "Refused to connect to %s", addr)
+			conn.writeMessage(504, "Data connections to hosts other than the client's are not allowed")
+			return false
+		}
+	}
+
+	return true
+}
+
+func (conn *Conn) allowDataHost(host, client string) bool {
+	if host == client {
+		return true
+	}
+
+	for _, allowed := range conn.server.ThirdPartyHosts {
+		if allowed == "*" || canonicalHost(allowed) == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalHost returns the host of an address in a comparable form,
+// such as "1-ff00:0:110,127.0.0.1" for "1-ff00:0:110,[127.0.0.1]"
+func canonicalHost(host string) string {
+	ia, ip := "", strings.NewReplacer("[", "", "]", "").Replace(host)
+	if i := strings.Index(ip, ","); i != -1 {
+		ia, ip = ip[:i+1], ip[i+1:]
+	}
+
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	return ia + ip
+}
+
+// dialDataConns connects to the data ports another server opened for a
+// transfer between two servers, as requested by PORT, EPRT or SPOR
+func (conn *Conn) dialDataConns(addrs []string) ([]socket.DataSocket, error) {
+	ports := make([]int, len(addrs))
+	for i, addr := range addrs {
+		_, port, err := transport.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ports[i] = port
+	}
+
+	var conns []scion.Conn
+
+	// Striped connections should not compete for the same path
+	if multipath, ok := conn.server.Transport.(transport.Multipath); ok && len(addrs) > 1 {
+		var err error
+		conns, err = multipath.DialMultipath(conn.server.Hostname, addrs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, addr := range addrs {
+			c, err := conn.server.Transport.Dial(conn.server.Hostname, addr)
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, err
+			}
+
+			conns = append(conns, c)
+		}
+	}
+
+	protect := conn.protector()
+	sockets := make([]socket.DataSocket, len(conns))
+	for i := range conns {
+		sockets[i] = socket.NewScionSocket(protect(conns[i]), ports[i])
+	}
+
+	return sockets, nil
+}
+
+// requireDataConn reports whether a data connection has been set up for
+// the next transfer in the current mode, otherwise it replies with 425.
+// Stream mode requires a single data connection, extended block mode
+// either striped ones or a single one. Data connections that are not
+// protected as required by PROT and the server are refused with 521
+func (conn *Conn) requireDataConn() bool {
+	ready := conn.socket != nil
+	if conn.extendedMode {
+		ready = ready || conn.parallelSockets != nil
+	}
+
+	if !ready {
+		conn.writeMessage(425, "Can't open data connection")
+		return false
+	}
+
+	if conn.dataProtection != conn.protection || conn.dataProtection < conn.server.minProtection {
+		conn.writeMessage(521, "Data connection cannot be opened with this PROT setting")
+		return false
+	}
+
+	return true
+}
+
 func (conn *Conn) getActiveSocket() socket.DataSocket {
 
 	if conn.extendedMode {
+		// After PASV or EPSV, the blocks are sent over a single stream
+		if conn.parallelSockets == nil && conn.socket != nil {
+			conn.parallelSockets = conn.newStripedSocket([]socket.DataSocket{conn.socket})
+			conn.socket = nil
+		}
 		return conn.parallelSockets
 	} else {
 		return conn.socket
@@ -287,17 +689,44 @@ func (conn *Conn) getActiveSocket() socket.DataSocket {
 
 }
 
-func (conn *Conn) closeActiveSocket() {
-
-	message := "Closing data connection"
-	conn.writeMessage(226, message)
+// closeActiveSocket closes the data connection after a transfer and replies
+// with 226. Closing reports whether all data has been delivered, otherwise
+// a dataConnError is returned without reply
+func (conn *Conn) closeActiveSocket() error {
+	var err error
 
 	if conn.extendedMode {
-		conn.parallelSockets.Close()
+		// Closing waits until all data has been sent,
+		// which the final performance markers count
+		err = conn.parallelSockets.Close()
 		conn.parallelSockets = nil
+		conn.stopPerfMarkers()
 	} else {
-		conn.socket.Close()
+		err = conn.socket.Close()
 		conn.socket = nil
 	}
 
+	if err != nil {
+		return dataConnError{err}
+	}
+
+	message := "Closing data connection"
+	conn.writeMessage(226, message)
+
+	return nil
+}
+
+// dataConnError is a failure of the data connection, as opposed to
+// a failure reading the file
+type dataConnError struct {
+	error
+}
+
+// writeTransferError replies to a transfer that failed after it started
+func (conn *Conn) writeTransferError(err error) {
+	if _, ok := err.(dataConnError); ok {
+		conn.writeMessage(426, fmt.Sprint("Connection closed; transfer aborted: ", err))
+	} else {
+		conn.writeMessage(551, "Error reading file")
+	}
 }
@@ -5,7 +5,14 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
 	"testing"
+
+	"github.com/elwin/transmit/socket"
 )
 
 func TestConnBuildPath(t *testing.T) {
@@ -32,3 +39,91 @@ func TestConnBuildPath(t *testing.T) {
 		})
 	}
 }
+
+func TestConnBuildPathHome(t *testing.T) {
+	c := &Conn{
+		namePrefix: "/files",
+		principal:  &Principal{HomeDir: "/team"},
+	}
+	var pathtests = []struct {
+		in  string
+		out string
+	}{
+		{"", "/team/files"},
+		{"/", "/team"},
+		{"one.txt", "/team/files/one.txt"},
+		{"/two.txt", "/team/two.txt"},
+		{"../../../etc/passwd", "/team/etc/passwd"},
+		{"/../other/three.txt", "/team/other/three.txt"},
+	}
+	for _, tt := range pathtests {
+		t.Run(tt.in, func(t *testing.T) {
+			s := c.buildPath(tt.in)
+			if s != tt.out {
+				t.Errorf("got %q, want %q", s, tt.out)
+			}
+		})
+	}
+}
+
+func TestPrincipalAllows(t *testing.T) {
+	readOnly := &Principal{ReadOnly: true}
+	listOnly := &Principal{Commands: []string{"list"}}
+
+	var allowTests = []struct {
+		principal *Principal
+		command   string
+		allow     bool
+	}{
+		{nil, "STOR", true},
+		{readOnly, "RETR", true},
+		{readOnly, "HASH", true},
+		{readOnly, "PASV", true},
+		{readOnly, "STOR", false},
+		{readOnly, "XRMD", false},
+		// Commands that are not known to only read are denied
+		{readOnly, "ESTO", false},
+		{readOnly, "SITE", false},
+		{listOnly, "LIST", true},
+		{listOnly, "EPSV", true},
+		{listOnly, "CKSM", false},
+		{listOnly, "SITE", false},
+	}
+
+	for _, tt := range allowTests {
+		if allow := tt.principal.allows(tt.command); allow != tt.allow {
+			t.Errorf("%+v %s: got %t, want %t", tt.principal, tt.command, allow, tt.allow)
+		}
+	}
+}
+
+// closeFailingSocket fails to deliver the data when closed
+type closeFailingSocket struct {
+	socket.DataSocket
+}
+
+func (closeFailingSocket) Close() error {
+	return errors.New("data stream failed")
+}
+
+func TestConnCloseActiveSocketFailure(t *testing.T) {
+	var out bytes.Buffer
+	c := &Conn{
+		socket:        closeFailingSocket{},
+		controlWriter: bufio.NewWriter(&out),
+		logger:        new(DiscardLogger),
+	}
+
+	err := c.sendOutofBandDataWriter(ioutil.NopCloser(strings.NewReader("")))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.socket != nil {
+		t.Errorf("expected the socket to be released")
+	}
+
+	c.writeTransferError(err)
+	if reply := out.String(); !strings.HasPrefix(reply, "426 ") {
+		t.Errorf("got reply %q, want 426", reply)
+	}
+}
@@ -59,3 +59,42 @@ type Driver interface {
 	// returns - the number of bytes writen and the first error encountered while writing, if any.
 	PutFile(string, io.Reader, bool) (int64, error)
 }
+
+// WriterAtDriver can optionally be implemented by a Driver that writes files
+// at arbitrary offsets. Uploads in extended block mode are then written as the
+// segments arrive, and interrupted uploads can be resumed
+type WriterAtDriver interface {
+	// params  - destination path, whether to keep the existing content
+	// returns - the file to write the data to, created if it doesn't exist
+	OpenFile(string, bool) (WriterAtCloser, error)
+}
+
+type WriterAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// ReaderAtDriver can optionally be implemented by a Driver that reads files
+// at arbitrary offsets. Downloads in extended block mode are then read on all
+// streams in parallel, and interrupted downloads can be resumed
+type ReaderAtDriver interface {
+	// params  - path
+	// returns - the file to read the data from, safe for parallel reads,
+	//           and its size
+	OpenReader(string) (ReaderAtCloser, int64, error)
+}
+
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// HashDriver can optionally be implemented by a Driver that keeps the hashes
+// of its files, e.g. computed while storing them. The CKSM and HASH commands
+// read the file to compute a hash the driver doesn't have
+type HashDriver interface {
+	// params  - path, algorithm as in checksum.Algorithms, offset and length,
+	//           which is -1 for the rest of the file
+	// returns - the hex encoded hash, or an empty string if it isn't stored
+	Hash(string, string, int64, int64) (string, error)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	_ Auth = &HtpasswdAuth{}
+)
+
+// unknownUserHash is compared with the passwords of unknown users, which
+// then take as long to refuse as known users with a wrong password
+const unknownUserHash = "$2a$10$4ZSVP7BW7vG9xPakSwyEkugGywj52YfFSL2bgRqL60wObsql/Su6i"
+
+// HtpasswdAuth implements Auth with the users of an htpasswd file, which
+// has a line "name:hash" per user. The hashes are either bcrypt, as created
+// by htpasswd -B, or argon2 in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$salt$hash". Other hashes are refused.
+// The file is read again on Reload, or when it changes if watched
+type HtpasswdAuth struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswdAuth reads the users from the htpasswd file at path
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads the file again, the users of established sessions stay
+// logged in. If the file is invalid, the previous users are kept
+func (a *HtpasswdAuth) Reload() error {
+	content, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	users, err := parseHtpasswd(content)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, which
+// is checked every interval, until stop is called. The result of each
+// reload is passed to reloaded, which may be nil
+func (a *HtpasswdAuth) Watch(interval time.Duration, reloaded func(error)) (stop func()) {
+	var last time.Time
+	if info, err := os.Stat(a.path); err == nil {
+		last = info.ModTime()
+	}
+
+	return every(interval, func() {
+		info, err := os.Stat(a.path)
+		if err != nil || info.ModTime().Equal(last) {
+			return
+		}
+		last = info.ModTime()
+
+		err = a.Reload()
+		if reloaded != nil {
+			reloaded(err)
+		}
+	})
+}
+
+// CheckPasswd will check user's password
+func (a *HtpasswdAuth) CheckPasswd(name, pass string) (bool, error) {
+	a.mu.RLock()
+	hash, ok := a.users[name]
+	a.mu.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte(pass))
+		return false, nil
+	}
+
+	if strings.HasPrefix(hash, "$argon2") {
+		return checkArgon2(hash, pass)
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func parseHtpasswd(content []byte) (map[string]string, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected name:hash", line)
+		}
+
+		name, hash := parts[0], parts[1]
+		if err := validateHash(hash); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		users[name] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+func validateHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := parseArgon2(hash)
+		return err
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("unsupported hash, use bcrypt or argon2")
+	}
+
+	return nil
+}
+
+type argon2Hash struct {
+	variant string // argon2i or argon2id
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 parses a hash in the PHC string format
+func parseArgon2(hash string) (*argon2Hash, error) {
+	invalid := fmt.Errorf("invalid argon2 hash")
+
+	// "", variant, version, parameters, salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, invalid
+	}
+
+	h := &argon2Hash{variant: parts[1]}
+	if h.variant != "argon2i" && h.variant != "argon2id" {
+		return nil, fmt.Errorf("unsupported variant %s", h.variant)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, invalid
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, invalid
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, invalid
+	}
+
+	var err error
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, invalid
+	}
+
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 {
+		return nil, invalid
+	}
+
+	return h, nil
+}
+
+func checkArgon2(hash, pass string) (bool, error) {
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(pass), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(pass), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
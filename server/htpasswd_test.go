@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, pass string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+func argon2PHC(pass string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pass), salt, 1, 64, 1, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeHtpasswd(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, path, "# Users\nalice:"+bcryptHash(t, "secret")+"\n\nbob:"+argon2PHC("hunter2")+"\n")
+
+	auth, err := NewHtpasswdAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var passwdTests = []struct {
+		name, pass string
+		ok         bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "hunter2", false},
+		{"bob", "hunter2", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+	}
+
+	for _, tt := range passwdTests {
+		t.Run(tt.name+":"+tt.pass, func(t *testing.T) {
+			ok, err := auth.CheckPasswd(tt.name, tt.pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Errorf("got %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+
+	// Unknown users are refused after a comparison as costly as for known ones
+	if cost, err := bcrypt.Cost([]byte(unknownUserHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("unknownUserHash: got cost %d, %v", cost, err)
+	}
+
+	// Invalid files keep the previous users
+	for _, content := range []string{"alice", "alice:secret", "alice:$apr1$salt$hash", "bob:$argon2id$v=19$m=64,t=0,p=1$c2FsdA$aGFzaA"} {
+		writeHtpasswd(t, path, content)
+		if err := auth.Reload(); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+	if ok, _ := auth.CheckPasswd("alice", "secret"); !ok {
+		t.Errorf("expected the previous users to be kept")
+	}
+}
+
+func TestHtpasswdAuthWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, path, "alice:"+bcryptHash(t, "secret"))
+
+	auth, err := NewHtpasswdAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan error, 1)
+	stop := auth.Watch(10*time.Millisecond, func(err error) { reloaded <- err })
+	defer stop()
+
+	writeHtpasswd(t, path, "alice:"+bcryptHash(t, "changed"))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file not reloaded")
+	}
+
+	if ok, _ := auth.CheckPasswd("alice", "changed"); !ok {
+		t.Errorf("expected the new password")
+	}
+}
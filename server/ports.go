@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
+)
+
+// The passive ports, unless ServerOpts.PassivePorts is set
+const (
+	defaultMinPassivePort = 40000
+	defaultMaxPassivePort = 49999
+)
+
+// portRange hands out the passive ports of a server. A port serves
+// a single data connection at a time, also across sessions, until
+// the listener on it is closed
+type portRange struct {
+	min, max int
+
+	mu    sync.Mutex
+	inUse map[int]bool
+}
+
+// parsePortRange parses a range of ports such as "40000-49999",
+// an empty string stands for the default range
+func parsePortRange(ports string) (*portRange, error) {
+	r := &portRange{
+		min:   defaultMinPassivePort,
+		max:   defaultMaxPassivePort,
+		inUse: make(map[int]bool),
+	}
+
+	if strings.TrimSpace(ports) == "" {
+		return r, nil
+	}
+
+	bounds := strings.Split(ports, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid port range %s", ports)
+	}
+
+	var err error
+	r.min, err = strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s", ports)
+	}
+
+	r.max, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s", ports)
+	}
+
+	if r.min < 1 || r.max > 65535 || r.min > r.max {
+		return nil, fmt.Errorf("invalid port range %s", ports)
+	}
+
+	return r, nil
+}
+
+// listen listens on host at a port of the range that is not in use.
+// Starting at a random port, it tries each of them once, skipping
+// those another process is bound to
+func (r *portRange) listen(t transport.Transport, host string) (scion.Listener, int, error) {
+	size := r.max - r.min + 1
+	start := rand.Intn(size)
+
+	for i := 0; i < size; i++ {
+		port := r.min + (start+i)%size
+		if !r.acquire(port) {
+			continue
+		}
+
+		listener, err := t.Listen(host + ":" + strconv.Itoa(port))
+		if err != nil {
+			r.release(port)
+			continue
+		}
+
+		return &rangeListener{Listener: listener, release: func() { r.release(port) }}, port, nil
+	}
+
+	return nil, 0, fmt.Errorf("no free port in range %d-%d", r.min, r.max)
+}
+
+func (r *portRange) acquire(port int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inUse[port] {
+		return false
+	}
+
+	r.inUse[port] = true
+	return true
+}
+
+func (r *portRange) release(port int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.inUse, port)
+}
+
+// rangeListener frees its port once it is closed
+type rangeListener struct {
+	scion.Listener
+	release func()
+	once    sync.Once
+}
+
+func (listener *rangeListener) Close() error {
+	err := listener.Listener.Close()
+	listener.once.Do(listener.release)
+
+	return err
+}
+
+// passiveSocket is a data connection accepted on a passive port,
+// which is freed along with the connection
+type passiveSocket struct {
+	socket.DataSocket
+	listener scion.Listener
+}
+
+func (s *passiveSocket) Close() error {
+	err := s.DataSocket.Close()
+	s.listener.Close()
+
+	return err
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/elwin/transmit/transport"
+)
+
+func TestParsePortRange(t *testing.T) {
+	var rangeTests = []struct {
+		in       string
+		min, max int
+		valid    bool
+	}{
+		{"", defaultMinPassivePort, defaultMaxPassivePort, true},
+		{"52000-52100", 52000, 52100, true},
+		{" 52000 - 52000 ", 52000, 52000, true},
+		{"52000", 0, 0, false},
+		{"52100-52000", 0, 0, false},
+		{"0-100", 0, 0, false},
+		{"60000-70000", 0, 0, false},
+		{"a-b", 0, 0, false},
+	}
+
+	for _, tt := range rangeTests {
+		t.Run(tt.in, func(t *testing.T) {
+			r, err := parsePortRange(tt.in)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("expected an error for %q", tt.in)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.min != tt.min || r.max != tt.max {
+				t.Errorf("got %d-%d, want %d-%d", r.min, r.max, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestPortRangeListen(t *testing.T) {
+	network := transport.NewMemory()
+
+	r, err := parsePortRange("52000-52002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bound by someone else
+	other, err := network.Listen("server:52001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	first, firstPort, err := r.listen(network, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, secondPort, err := r.listen(network, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if firstPort == secondPort || firstPort == 52001 || secondPort == 52001 {
+		t.Errorf("got ports %d and %d", firstPort, secondPort)
+	}
+
+	if _, _, err := r.listen(network, "server"); err == nil {
+		t.Errorf("expected all ports to be in use")
+	}
+
+	// Closing frees the port
+	first.Close()
+	first.Close()
+
+	_, port, err := r.listen(network, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != firstPort {
+		t.Errorf("got port %d, want %d", port, firstPort)
+	}
+
+	second.Close()
+}
+
+func TestInvalidPassivePorts(t *testing.T) {
+	s := NewServer(&ServerOpts{PassivePorts: "50000-40000", Transport: transport.NewMemory()})
+	if err := s.ListenAndServe(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
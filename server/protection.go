@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/transport"
+)
+
+// protectionLevel is the protection of data connections set by PROT
+// (RFC 2228), ordered from the weakest to the strongest
+type protectionLevel int
+
+const (
+	protectionClear        protectionLevel = iota // C
+	protectionSafe                                // S, integrity
+	protectionConfidential                        // E, confidentiality
+	protectionPrivate                             // P, integrity and confidentiality
+)
+
+func (level protectionLevel) String() string {
+	return [...]string{"C", "S", "E", "P"}[level]
+}
+
+// parseProtectionLevel parses the code of a protection level,
+// an empty string stands for clear
+func parseProtectionLevel(code string) (protectionLevel, error) {
+	switch strings.ToUpper(strings.TrimSpace(code)) {
+	case "", "C":
+		return protectionClear, nil
+	case "S":
+		return protectionSafe, nil
+	case "E":
+		return protectionConfidential, nil
+	case "P":
+		return protectionPrivate, nil
+	default:
+		return protectionClear, fmt.Errorf("invalid protection level %s", code)
+	}
+}
+
+// protector returns how the data connections set up next are secured,
+// at the current protection level. The level is kept along with them
+// to check it before each transfer, see requireDataConn. Independent of
+// who connected, the server takes the role of the TLS server (RFC 4217),
+// unless SSCN switched it to the client role. Then the server on the
+// other end of a third-party transfer takes the role of the TLS server
+func (conn *Conn) protector() func(scion.Conn) scion.Conn {
+	level := conn.protection
+	conn.dataProtection = level
+
+	if conn.tlsClient && level != protectionClear {
+		// Without DCAU, the peer is not authenticated, only the
+		// client that set up the transfer over the control connection
+		config := conn.tlsConfig.Clone()
+		config.InsecureSkipVerify = true
+
+		return func(stream scion.Conn) scion.Conn {
+			return transport.TLSClient(stream, config)
+		}
+	}
+
+	return func(stream scion.Conn) scion.Conn {
+		if level == protectionClear {
+			return stream
+		}
+
+		return transport.TLSServer(stream, conn.tlsConfig)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"path"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quota limits the size of an upload to what the quota of the user
+// leaves. Content that is overwritten doesn't count, appended content
+// does. Safe for concurrent use, segments are written in parallel
+type quota struct {
+	limit  int64
+	unlock func()
+
+	mu       sync.Mutex
+	exceeded bool
+}
+
+// uploadQuota returns the quota for an upload to path, or nil if the
+// user has no quota. Other uploads to the home directory wait until the
+// quota is released, otherwise each of them could use the space left
+func (conn *Conn) uploadQuota(path string) (*quota, error) {
+	if conn.principal == nil || conn.principal.Quota <= 0 {
+		return nil, nil
+	}
+
+	home := conn.buildPath("/")
+	unlock := conn.server.quotaLocks.lock(home)
+
+	used, err := conn.dirSize(home)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	limit := conn.principal.Quota - used
+	if info, err := conn.driver.Stat(path); err == nil && !conn.appendData {
+		limit += info.Size()
+	}
+
+	return &quota{limit: limit, unlock: unlock}, nil
+}
+
+// release lets the next upload to the home directory check the quota,
+// once the upload is complete
+func (q *quota) release() {
+	if q != nil {
+		q.unlock()
+	}
+}
+
+// quotaLocks serializes the uploads to each home directory with a quota
+type quotaLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock waits until no other upload to dir is running, the returned
+// function unlocks it
+func (l *quotaLocks) lock(dir string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := l.locks[dir]
+	if !ok {
+		lock = new(sync.Mutex)
+		l.locks[dir] = lock
+	}
+	l.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// dirSize returns the total size of the files in dir and its subdirectories
+func (conn *Conn) dirSize(dir string) (int64, error) {
+	var size int64
+	var subdirs []string
+
+	err := conn.driver.ListDir(dir, func(info FileInfo) error {
+		if info.IsDir() {
+			subdirs = append(subdirs, path.Join(dir, info.Name()))
+		} else {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, subdir := range subdirs {
+		n, err := conn.dirSize(subdir)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+
+	return size, nil
+}
+
+// wasExceeded reports whether the upload has been aborted
+func (q *quota) wasExceeded() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.exceeded
+}
+
+// check reports whether end bytes fit into the quota
+func (q *quota) check(end int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if end > q.limit {
+		q.exceeded = true
+		return errQuotaExceeded
+	}
+
+	return nil
+}
+
+// reader fails once more than the limit has been read from r
+func (q *quota) reader(r io.Reader) io.Reader {
+	if q == nil {
+		return r
+	}
+
+	return &quotaReader{quota: q, reader: r}
+}
+
+// writerAt fails writing beyond the limit
+func (q *quota) writerAt(w WriterAtCloser) WriterAtCloser {
+	if q == nil {
+		return w
+	}
+
+	return &quotaWriterAt{w, q}
+}
+
+type quotaReader struct {
+	quota  *quota
+	reader io.Reader
+	read   int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+
+	if quotaErr := r.quota.check(r.read); quotaErr != nil {
+		return 0, quotaErr
+	}
+
+	return n, err
+}
+
+type quotaWriterAt struct {
+	WriterAtCloser
+	quota *quota
+}
+
+func (w *quotaWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.quota.check(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return w.WriterAtCloser.WriteAt(p, off)
+}
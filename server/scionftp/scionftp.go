@@ -9,9 +9,15 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	filedriver "github.com/elwin/file-driver"
 	"github.com/elwin/transmit/server"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
 )
 
 func main() {
@@ -19,8 +25,16 @@ func main() {
 		root = flag.String("root", "", "Root directory to serve")
 		user = flag.String("user", "admin", "Username for login")
 		pass = flag.String("pass", "123456", "Password for login")
+		file = flag.String("passwd-file", "", "htpasswd file with bcrypt or argon2 hashes, replaces -user and -pass")
 		port = flag.Int("port", 2121, "Port")
 		host = flag.String("host", "", "Hostname (Format: AS,[IP])")
+		tr   = flag.String("transport", "scion", "Transport (scion or tcp)")
+
+		passivePorts = flag.String("passive-ports", "40000-49999", "Range of ports for data connections")
+
+		parallelism    = flag.Int("parallelism", 4, "Default number of parallel streams")
+		maxParallelism = flag.Int("max-parallelism", 16, "Maximum number of parallel streams")
+		redundant      = flag.Bool("redundant", false, "Also send segments of the slowest stream over the fastest one")
 	)
 	flag.Parse()
 	if *root == "" {
@@ -31,24 +45,75 @@ func main() {
 		log.Fatalf("Please set a host with -host")
 	}
 
+	t, err := transport.Lookup(*tr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	factory := &filedriver.FileDriverFactory{
 		RootPath: *root,
 		Perm:     server.NewSimplePerm("user", "group"),
 	}
 
+	var auth server.Auth = &server.SimpleAuth{Name: *user, Password: *pass}
+	if *file != "" {
+		auth, err = loadPasswdFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	opts := &server.ServerOpts{
-		Factory:  factory,
-		Port:     *port,
-		Hostname: *host,
-		Auth:     &server.SimpleAuth{Name: *user, Password: *pass},
-		PublicIp: *host,
+		Factory:   factory,
+		Port:      *port,
+		Hostname:  *host,
+		Auth:      auth,
+		PublicIp:  *host,
+		Transport: t,
+
+		PassivePorts: *passivePorts,
+
+		Parallelism:    *parallelism,
+		MaxParallelism: *maxParallelism,
+		Scheduler:      &socket.Weighted{Redundant: *redundant},
 	}
 
 	log.Printf("Starting ftp server on %v:%v", opts.Hostname, opts.Port)
-	log.Printf("Username %v, Password %v", *user, *pass)
+	if *file == "" {
+		log.Printf("Username %v, Password %v", *user, *pass)
+	}
 	server := server.NewServer(opts)
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil {
 		log.Fatal("Error starting server:", err)
 	}
 }
+
+// loadPasswdFile reads the users from an htpasswd file, which is
+// reloaded on SIGHUP and whenever it changes
+func loadPasswdFile(path string) (*server.HtpasswdAuth, error) {
+	auth, err := server.NewHtpasswdAuth(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reloaded := func(err error) {
+		if err != nil {
+			log.Printf("Keeping the previous users: %v", err)
+		} else {
+			log.Printf("Reloaded users from %s", path)
+		}
+	}
+
+	auth.Watch(5*time.Second, reloaded)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloaded(auth.Reload())
+		}
+	}()
+
+	return auth, nil
+}
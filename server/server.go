@@ -10,9 +10,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/elwin/transmit/checksum"
 	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/socket"
+	"github.com/elwin/transmit/transport"
 	"net"
 	"strconv"
+	"time"
 )
 
 // Version returns the library version
@@ -38,14 +42,18 @@ type ServerOpts struct {
 	// Public IP of the server
 	PublicIp string
 
-	// Passive ports
+	// The range of passive ports, e.g. "40000-49999". Each port serves
+	// a single data connection at a time. An invalid range fails
+	// ListenAndServe
+	// Optional, defaults to 40000-49999
 	PassivePorts string
 
 	// The port that the FTP should listen on. Optional, defaults to 3000. In
 	// a production environment you will probably want to change this to 21.
 	Port int
 
-	// use tls, default is false
+	// use tls, default is false. Users have to log in over a secured
+	// control connection, data connections are secured after PROT P
 	TLS bool
 
 	// if tls used, cert file is required
@@ -54,17 +62,99 @@ type ServerOpts struct {
 	// if tls used, key file is required
 	KeyFile string
 
-	// If ture TLS is used in RFC4217 mode
+	// If true TLS is used in RFC4217 mode, the client secures the
+	// control connection with AUTH TLS. Otherwise TLS starts right
+	// away when the client connects (implicit FTPS)
 	ExplicitFTPS bool
 
+	// The minimum protection level of data connections, "C" (clear)
+	// or "P" (private), which requires TLS. Transfers over data
+	// connections with a lower level set by PROT are refused. The
+	// server takes the role of the TLS server, unless the client
+	// sends SSCN ON, as ftp.ThirdPartyCopy does. Other levels fail
+	// ListenAndServe
+	// Optional, defaults to "C"
+	MinProtectionLevel string
+
+	// The hosts besides the client's that PORT, EPRT and SPOR may make
+	// the server connect to, e.g. the other servers of third-party
+	// transfers, "*" allows any host. Other hosts are refused, which
+	// prevents FTP bounce attacks
+	// Optional, defaults to none
+	ThirdPartyHosts []string
+
+	// Restricts sessions and commands by the address of the client,
+	// the rules can be reloaded while the server is running
+	// Optional, defaults to allowing everyone
+	ACL *ACL
+
 	WelcomeMessage string
 
 	// A logger implementation, if nil the StdLogger is used
 	Logger Logger
 
-	// The maximum length that may be used when sending in parallel mode
-	// Optional, defaults to 1000
+	// The bounds of the segment length when sending in parallel mode,
+	// in between the length is adapted to the measured throughput.
+	// Clients that don't acknowledge segments get the maximum length
+	// Optional, default to 1000 and 1 MiB
+	MinChunkLength int
 	MaxChunkLength int
+
+	// If true, parallel streams that are considerably slower than the
+	// others are only used occasionally when sending in parallel mode,
+	// given that the client acknowledges segments
+	AdaptiveStreams bool
+
+	// The number of parallel streams opened by SPAS, unless the
+	// client requests otherwise with OPTS RETR Parallelism=n,n,n;
+	// Optional, defaults to 4
+	Parallelism int
+
+	// The maximum number of parallel streams a client may request
+	// Optional, defaults to 16
+	MaxParallelism int
+
+	// The number of bytes buffered to reassemble the data received
+	// over parallel streams in order, streams that are ahead of the
+	// others stop receiving once it is reached. Longer segments fail
+	// their stream, it has to exceed the chunk length of clients
+	// Optional, defaults to socket.BufferSize
+	ReceiveBufferSize int
+
+	// Distributes the segments over the parallel streams if the client
+	// acknowledges segments, otherwise each segment is sent over the
+	// first stream that is ready
+	// Optional, defaults to socket.Weighted without redundancy
+	Scheduler socket.Scheduler
+
+	// How often the ranges received in extended block mode are
+	// reported to the client, which resumes interrupted uploads
+	// with them
+	// Optional, defaults to 5 seconds
+	MarkerInterval time.Duration
+
+	// How often the bytes transferred over each stream in
+	// extended block mode are reported to the client
+	// Optional, defaults to 5 seconds
+	PerfInterval time.Duration
+
+	// How long to wait for the client to connect to the passive
+	// ports opened by PASV, EPSV or SPAS. The next transfer fails
+	// with 425 if it doesn't
+	// Optional, defaults to 1 minute
+	AcceptTimeout time.Duration
+
+	// The transport used for the control and data connections
+	// Optional, defaults to SCION
+	Transport transport.Transport
+
+	// Selects the SCION paths of connections initiated by the server,
+	// i.e. the data connections after PORT, EPRT or SPOR. Connections
+	// accepted by the server, the control connection and the data
+	// connections in passive mode, are answered over the path chosen
+	// by the client. Requires a transport.PathSelector, such as SCION
+	// Optional, defaults to the shortest path
+	PathPolicy scion.PathPolicy
 }
 
 // Server is the root of your FTP application. You should instantiate one
@@ -73,13 +163,17 @@ type ServerOpts struct {
 // Always use the NewServer() method to create a new Server.
 type Server struct {
 	*ServerOpts
-	listenTo  string
-	logger    Logger
-	listener  scion.Listener
-	tlsConfig *tls.Config
-	ctx       context.Context
-	cancel    context.CancelFunc
-	feats     string
+	listenTo      string
+	logger        Logger
+	listener      scion.Listener
+	tlsConfig     *tls.Config
+	ctx           context.Context
+	cancel        context.CancelFunc
+	feats         string
+	ports         *portRange // Passive ports
+	minProtection protectionLevel
+	err           error // Invalid options, returned by ListenAndServe
+	quotaLocks    *quotaLocks
 }
 
 func (server Server) HostAddress() string {
@@ -130,15 +224,83 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 	}
 
 	if opts.MaxChunkLength == 0 {
-		newOpts.MaxChunkLength = 1000
+		newOpts.MaxChunkLength = 1 << 20
 	} else {
 		newOpts.MaxChunkLength = opts.MaxChunkLength
 	}
 
+	if opts.MinChunkLength == 0 {
+		newOpts.MinChunkLength = 1000
+	} else {
+		newOpts.MinChunkLength = opts.MinChunkLength
+	}
+
+	if newOpts.MinChunkLength > newOpts.MaxChunkLength {
+		newOpts.MinChunkLength = newOpts.MaxChunkLength
+	}
+	newOpts.AdaptiveStreams = opts.AdaptiveStreams
+
+	if opts.MaxParallelism == 0 {
+		newOpts.MaxParallelism = 16
+	} else {
+		newOpts.MaxParallelism = opts.MaxParallelism
+	}
+
+	if opts.Parallelism == 0 {
+		newOpts.Parallelism = 4
+	} else {
+		newOpts.Parallelism = opts.Parallelism
+	}
+
+	if newOpts.Parallelism > newOpts.MaxParallelism {
+		newOpts.Parallelism = newOpts.MaxParallelism
+	}
+
+	if opts.ReceiveBufferSize == 0 {
+		newOpts.ReceiveBufferSize = socket.BufferSize
+	} else {
+		newOpts.ReceiveBufferSize = opts.ReceiveBufferSize
+	}
+
+	if opts.Scheduler == nil {
+		newOpts.Scheduler = &socket.Weighted{}
+	} else {
+		newOpts.Scheduler = opts.Scheduler
+	}
+
+	if opts.MarkerInterval == 0 {
+		newOpts.MarkerInterval = 5 * time.Second
+	} else {
+		newOpts.MarkerInterval = opts.MarkerInterval
+	}
+
+	if opts.PerfInterval == 0 {
+		newOpts.PerfInterval = 5 * time.Second
+	} else {
+		newOpts.PerfInterval = opts.PerfInterval
+	}
+
+	if opts.AcceptTimeout == 0 {
+		newOpts.AcceptTimeout = time.Minute
+	} else {
+		newOpts.AcceptTimeout = opts.AcceptTimeout
+	}
+
+	if opts.Transport == nil {
+		newOpts.Transport = transport.Scion{}
+	} else {
+		newOpts.Transport = opts.Transport
+	}
+	newOpts.PathPolicy = opts.PathPolicy
+	newOpts.Transport = transport.WithPathPolicy(newOpts.Transport, opts.PathPolicy)
+
 	newOpts.TLS = opts.TLS
 	newOpts.KeyFile = opts.KeyFile
 	newOpts.CertFile = opts.CertFile
 	newOpts.ExplicitFTPS = opts.ExplicitFTPS
+	newOpts.MinProtectionLevel = opts.MinProtectionLevel
+	newOpts.ACL = opts.ACL
+	newOpts.ThirdPartyHosts = opts.ThirdPartyHosts
 
 	newOpts.PublicIp = opts.PublicIp
 	newOpts.PassivePorts = opts.PassivePorts
@@ -169,6 +331,19 @@ func NewServer(opts *ServerOpts) *Server {
 	s.ServerOpts = opts
 	s.listenTo = net.JoinHostPort(opts.Hostname, strconv.Itoa(opts.Port))
 	s.logger = opts.Logger
+	s.quotaLocks = new(quotaLocks)
+
+	var err error
+	s.ports, err = parsePortRange(opts.PassivePorts)
+	if err != nil {
+		s.err = fmt.Errorf("PassivePorts: %v", err)
+	}
+
+	s.minProtection, err = parseProtectionLevel(opts.MinProtectionLevel)
+	if err != nil && s.err == nil {
+		s.err = fmt.Errorf("MinProtectionLevel: %v", err)
+	}
+
 	return s
 }
 
@@ -188,6 +363,13 @@ func (server *Server) newConn(conn scion.Conn, driver Driver) *Conn {
 	c.sessionID = newSessionID()
 	c.logger = server.logger
 	c.tlsConfig = server.tlsConfig
+	c.parallelism = server.Parallelism
+	c.hashAlgorithm = checksum.Algorithms[0]
+
+	// Implicit FTPS
+	if _, ok := conn.(*transport.TLSConn); ok {
+		c.tls = true
+	}
 
 	driver.Init(c)
 	return c
@@ -208,6 +390,21 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	return config, nil
 }
 
+// tlsListener starts TLS on the connections it accepts, for implicit FTPS
+type tlsListener struct {
+	scion.Listener
+	config *tls.Config
+}
+
+func (listener *tlsListener) Accept() (scion.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.TLSServer(conn, listener.config), nil
+}
+
 // ListenAndServe asks a new Server to begin accepting client connections. It
 // accepts no arguments - all configuration is provided via the NewServer
 // function.
@@ -217,34 +414,31 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 // listening on the same port.
 //
 func (server *Server) ListenAndServe() error {
+	if server.err != nil {
+		return server.err
+	}
 
 	var listener scion.Listener
 	var err error
 	var curFeats = featCmds
 
 	if server.ServerOpts.TLS {
-		/*
-			server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
-			if err != nil {
-				return err
-			}
-
-			curFeats += " AUTH TLS\n PBSZ\n PROT\n"
-
-			if server.ServerOpts.ExplicitFTPS {
-				listener, err = net.Listen("tcp", server.listenTo)
-			} else {
-				listener, err = tls.Listen("tcp", server.listenTo, server.tlsConfig)
-			}
-		*/
-	} else {
-
-		listener, err = scion.Listen(server.HostAddress())
+		server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
+		if err != nil {
+			return err
+		}
 
+		curFeats += " AUTH TLS\n PBSZ\n PROT\n"
 	}
+
+	listener, err = server.Transport.Listen(server.HostAddress())
 	if err != nil {
 		return err
 	}
+
+	if server.ServerOpts.TLS && !server.ServerOpts.ExplicitFTPS {
+		listener = &tlsListener{listener, server.tlsConfig}
+	}
 	server.feats = fmt.Sprintf(feats, curFeats)
 
 	sessionID := ""
@@ -257,6 +451,9 @@ func (server *Server) ListenAndServe() error {
 // request in a new goroutine.
 //
 func (server *Server) Serve(l scion.Listener) error {
+	if server.err != nil {
+		return server.err
+	}
 
 	server.listener = l
 	server.ctx, server.cancel = context.WithCancel(context.Background())
@@ -5,34 +5,80 @@
 package server_test
 
 import (
-	"net"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	filedriver "github.com/goftp/file-driver"
-	"github.com/goftp/server"
-	"github.com/jlaffaye/ftp"
+	filedriver "github.com/elwin/file-driver"
+	ftp "github.com/elwin/transmit/client"
+	"github.com/elwin/transmit/mode"
+	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/server"
+	"github.com/elwin/transmit/transport"
 	"github.com/stretchr/testify/assert"
 )
 
-func runServer(t *testing.T, execute func()) {
-	os.MkdirAll("./testdata", os.ModePerm)
+const (
+	serverHost = "server"
+	clientHost = "client"
+)
+
+func serverOpts(t *testing.T, network transport.Transport) (*server.ServerOpts, func()) {
+	root, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var perm = server.NewSimplePerm("test", "test")
 	opt := &server.ServerOpts{
 		Name: "test ftpd",
 		Factory: &filedriver.FileDriverFactory{
-			RootPath: "./testdata",
+			RootPath: root,
 			Perm:     perm,
 		},
-		Port: 2121,
+		Hostname: serverHost,
+		Port:     2121,
 		Auth: &server.SimpleAuth{
 			Name:     "admin",
 			Password: "admin",
 		},
-		Logger: new(server.DiscardLogger),
+		Logger:    new(server.DiscardLogger),
+		Transport: network,
+	}
+
+	return opt, func() { os.RemoveAll(root) }
+}
+
+func runServer(t *testing.T, execute func(network transport.Transport)) {
+	runServerWith(t, nil, execute)
+}
+
+// runServerWith runs a test server with the options changed by configure
+func runServerWith(t *testing.T, configure func(*server.ServerOpts), execute func(network transport.Transport)) {
+	network := transport.NewMemory()
+	opt, cleanup := serverOpts(t, network)
+	defer cleanup()
+
+	if configure != nil {
+		configure(opt)
 	}
 
 	s := server.NewServer(opt)
@@ -41,98 +87,187 @@ func runServer(t *testing.T, execute func()) {
 		assert.EqualError(t, err, server.ErrServerClosed.Error())
 	}()
 
-	execute()
+	execute(network)
 
 	assert.NoError(t, s.Shutdown())
 }
 
+// wrapFactory configures the test server to wrap each driver it creates,
+// e.g. to override a method of the file driver
+func wrapFactory(wrap func(server.Driver) server.Driver) func(*server.ServerOpts) {
+	return func(opt *server.ServerOpts) {
+		opt.Factory = wrappedFactory{opt.Factory, wrap}
+	}
+}
+
+type wrappedFactory struct {
+	server.DriverFactory
+	wrap func(server.Driver) server.Driver
+}
+
+func (factory wrappedFactory) NewDriver() (server.Driver, error) {
+	driver, err := factory.DriverFactory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.wrap(driver), nil
+}
+
+// testContent returns random data that spans many segments,
+// the same data on every call
+func testContent() []byte {
+	content := make([]byte, 100*1000+123)
+	rand.New(rand.NewSource(0)).Read(content)
+	return content
+}
+
+// assertRetr downloads the file at path and compares it with content
+func assertRetr(t *testing.T, f *ftp.ServerConn, path string, content []byte) {
+	resp, err := f.Retr(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	buf, err := ioutil.ReadAll(resp)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(content, buf), "received data differs")
+	assert.NoError(t, resp.Close())
+}
+
+// dial connects to the test server, giving it 0.5 seconds
+// to get to the listening state
+func dial(t *testing.T, network transport.Transport, options ...ftp.DialOption) *ftp.ServerConn {
+	return dialHost(t, network, serverHost, options...)
+}
+
+// dialHost connects to the test server running on host
+func dialHost(t *testing.T, network transport.Transport, host string, options ...ftp.DialOption) *ftp.ServerConn {
+	return dialFrom(t, network, clientHost, host, options...)
+}
+
+// dialFrom connects from the local host to the test server running on host
+func dialFrom(t *testing.T, network transport.Transport, local, host string, options ...ftp.DialOption) *ftp.ServerConn {
+	options = append(options, ftp.DialWithTransport(network))
+
+	timeout := time.NewTimer(time.Millisecond * 500)
+	for {
+		f, err := ftp.Dial(local, host+":2121", options...)
+		if err != nil && len(timeout.C) == 0 { // Retry errors
+			continue
+		}
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		return f
+	}
+}
+
 func TestConnect(t *testing.T) {
-	runServer(t, func() {
-		// Give server 0.5 seconds to get to the listening state
-		timeout := time.NewTimer(time.Millisecond * 500)
-		for {
-			f, err := ftp.Connect("localhost:2121")
-			if err != nil && len(timeout.C) == 0 { // Retry errors
-				continue
-			}
-			assert.NoError(t, err)
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
 
-			assert.NoError(t, f.Login("admin", "admin"))
-			assert.Error(t, f.Login("admin", ""))
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.Error(t, f.Login("admin", ""))
 
-			var content = `test`
-			assert.NoError(t, f.Stor("server_test.go", strings.NewReader(content)))
+		var content = `test`
+		assert.NoError(t, f.Stor("server_test.go", strings.NewReader(content)))
 
-			names, err := f.NameList("/")
-			assert.NoError(t, err)
-			assert.EqualValues(t, 1, len(names))
-			assert.EqualValues(t, "server_test.go", names[0])
+		names, err := f.NameList("/")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, len(names))
+		assert.EqualValues(t, "server_test.go", names[0])
 
-			entries, err := f.List("/")
-			assert.NoError(t, err)
-			assert.EqualValues(t, 1, len(entries))
-			assert.EqualValues(t, "server_test.go", entries[0].Name)
-			assert.EqualValues(t, 4, entries[0].Size)
-			assert.EqualValues(t, ftp.EntryTypeFile, entries[0].Type)
+		entries, err := f.List("/")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, len(entries))
+		assert.EqualValues(t, "server_test.go", entries[0].Name)
+		assert.EqualValues(t, 4, entries[0].Size)
+		assert.EqualValues(t, ftp.EntryTypeFile, entries[0].Type)
 
-			curDir, err := f.CurrentDir()
-			assert.NoError(t, err)
-			assert.EqualValues(t, "/", curDir)
+		curDir, err := f.CurrentDir()
+		assert.NoError(t, err)
+		assert.EqualValues(t, "/", curDir)
 
-			size, err := f.FileSize("/server_test.go")
-			assert.NoError(t, err)
-			assert.EqualValues(t, 4, size)
+		size, err := f.FileSize("/server_test.go")
+		assert.NoError(t, err)
+		assert.EqualValues(t, 4, size)
 
-			/*resp, err := f.RetrFrom("/server_test.go", 0)
-			assert.NoError(t, err)
-			var buf []byte
-			l, err := resp.Read(buf)
-			assert.NoError(t, err)
-			assert.EqualValues(t, 4, l)
-			assert.EqualValues(t, 4, len(buf))
-			assert.EqualValues(t, content, string(buf))*/
+		resp, err := f.RetrFrom("/server_test.go", 0)
+		assert.NoError(t, err)
+		buf, err := ioutil.ReadAll(resp)
+		assert.NoError(t, err)
+		assert.EqualValues(t, content, string(buf))
+		assert.NoError(t, resp.Close())
 
-			err = f.Rename("/server_test.go", "/server.test.go")
-			assert.NoError(t, err)
+		err = f.Rename("/server_test.go", "/server.test.go")
+		assert.NoError(t, err)
 
-			err = f.MakeDir("/src")
-			assert.NoError(t, err)
+		err = f.MakeDir("/src")
+		assert.NoError(t, err)
 
-			err = f.Delete("/server.test.go")
-			assert.NoError(t, err)
+		err = f.Delete("/server.test.go")
+		assert.NoError(t, err)
 
-			err = f.RemoveDir("/src")
-			assert.NoError(t, err)
+		err = f.RemoveDir("/src")
+		assert.NoError(t, err)
 
-			err = f.Quit()
-			assert.NoError(t, err)
+		err = f.Quit()
+		assert.NoError(t, err)
+	})
+}
 
-			break
-		}
+func TestExtendedMode(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+		assertRetr(t, f, "striped", content)
+
+		assert.NoError(t, f.Quit())
 	})
 }
 
-func TestServe(t *testing.T) {
-	os.MkdirAll("./testdata", os.ModePerm)
+func TestRetrToFile(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
 
-	var perm = server.NewSimplePerm("test", "test")
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
 
-	// Server options without hostname or port
-	opt := &server.ServerOpts{
-		Name: "test ftpd",
-		Factory: &filedriver.FileDriverFactory{
-			RootPath: "./testdata",
-			Perm:     perm,
-		},
-		Auth: &server.SimpleAuth{
-			Name:     "admin",
-			Password: "admin",
-		},
-		Logger: new(server.DiscardLogger),
-	}
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+		file, err := ioutil.TempFile("", "transmit")
+		assert.NoError(t, err)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		assert.NoError(t, f.RetrToFile("striped", file))
+
+		buf, err := ioutil.ReadFile(file.Name())
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(content, buf), "received data differs")
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestServe(t *testing.T) {
+	network := transport.NewMemory()
+	opt, cleanup := serverOpts(t, network)
+	defer cleanup()
 
 	// Start the listener
-	l, err := net.Listen("tcp", ":2121")
+	l, err := network.Listen(serverHost + ":2121")
 	assert.NoError(t, err)
 
 	// Start the server using the listener
@@ -142,22 +277,1280 @@ func TestServe(t *testing.T) {
 		assert.EqualError(t, err, server.ErrServerClosed.Error())
 	}()
 
-	// Give server 0.5 seconds to get to the listening state
-	timeout := time.NewTimer(time.Millisecond * 500)
-	for {
-		f, err := ftp.Connect("localhost:2121")
-		if err != nil && len(timeout.C) == 0 { // Retry errors
-			continue
-		}
+	conn, err := network.Dial(clientHost, serverHost+":2121")
+	assert.NoError(t, err)
+
+	f, err := ftp.Dial(clientHost, serverHost+":2121",
+		ftp.DialWithNetConn(conn),
+		ftp.DialWithTransport(network))
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Login("admin", "admin"))
+	assert.Error(t, f.Login("admin", ""))
+
+	err = f.Quit()
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Shutdown())
+}
+
+// countingTransport counts the data connections the server accepts
+type countingTransport struct {
+	transport.Transport
+	accepted *int32
+}
+
+func (t countingTransport) Listen(address string) (scion.Listener, error) {
+	listener, err := t.Transport.Listen(address)
+	if err != nil || strings.HasSuffix(address, ":2121") {
+		return listener, err
+	}
+
+	return countingListener{listener, t.accepted}, nil
+}
+
+type countingListener struct {
+	scion.Listener
+	accepted *int32
+}
+
+func (l countingListener) Accept() (scion.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.accepted, 1)
+	}
+
+	return conn, err
+}
+
+func TestParallelism(t *testing.T) {
+	var accepted int32
+	configure := func(opt *server.ServerOpts) {
+		opt.Transport = countingTransport{opt.Transport, &accepted}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithParallelism(7))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+		assert.Equal(t, int32(7), atomic.LoadInt32(&accepted))
+
+		// The server allows at most 16 streams
+		assert.Error(t, f.SetParallelism(17))
+		assert.Error(t, f.SetParallelism(0))
+		assert.NoError(t, f.SetParallelism(1))
+
+		assertRetr(t, f, "striped", content)
+		assert.Equal(t, int32(8), atomic.LoadInt32(&accepted))
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+// positionalFactory adds positional reads and writes
+// to the file driver, which allows resuming transfers
+type positionalFactory struct {
+	*filedriver.FileDriverFactory
+}
+
+func (f positionalFactory) NewDriver() (server.Driver, error) {
+	driver, err := f.FileDriverFactory.NewDriver()
+	return positionalDriver{driver, f.RootPath}, err
+}
+
+// positionalDriver forwards the optional driver interfaces, which
+// the embedded Driver doesn't expose
+type positionalDriver struct {
+	server.Driver
+	root string
+}
+
+func (d positionalDriver) Hash(path, algorithm string, offset, length int64) (string, error) {
+	if driver, ok := d.Driver.(server.HashDriver); ok {
+		return driver.Hash(path, algorithm, offset, length)
+	}
+
+	return "", nil
+}
+
+func (d positionalDriver) OpenReader(path string) (server.ReaderAtCloser, int64, error) {
+	file, err := os.Open(filepath.Join(d.root, path))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+func (d positionalDriver) OpenFile(path string, keep bool) (server.WriterAtCloser, error) {
+	flag := os.O_WRONLY | os.O_CREATE
+	if !keep {
+		flag |= os.O_TRUNC
+	}
+
+	return os.OpenFile(filepath.Join(d.root, path), flag, 0644)
+}
+
+func TestResumeRetr(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.Factory = positionalFactory{opt.Factory.(*filedriver.FileDriverFactory)}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		f := dial(t, network)
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+		dir, err := ioutil.TempDir("", "transmit")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		// The ranges recorded by an interrupted transfer are not sent
+		// again, the local file keeps what it contains there
+		markers := filepath.Join(dir, "striped.markers")
+		assert.NoError(t, ioutil.WriteFile(markers, []byte("0-20000,50000-60007"), 0644))
+
+		expected := append([]byte(nil), content...)
+		copy(expected[0:20000], bytes.Repeat([]byte("x"), 20000))
+		copy(expected[50000:60007], bytes.Repeat([]byte("x"), 10007))
+
+		partial := append([]byte(nil), expected[:60007]...)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "striped"), partial, 0644))
+
+		file, err := os.OpenFile(filepath.Join(dir, "striped"), os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		defer file.Close()
+
+		assert.NoError(t, f.ResumeRetr("striped", file, markers))
+
+		buf, err := ioutil.ReadFile(file.Name())
 		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, buf), "received data differs")
+
+		_, err = os.Stat(markers)
+		assert.True(t, os.IsNotExist(err), "markers not removed")
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestResumeStor(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.Factory = positionalFactory{opt.Factory.(*filedriver.FileDriverFactory)}
+		opt.MarkerInterval = time.Millisecond
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		f := dial(t, network)
 
 		assert.NoError(t, f.Login("admin", "admin"))
-		assert.Error(t, f.Login("admin", ""))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
 
-		err = f.Quit()
+		content := testContent()
+
+		dir, err := ioutil.TempDir("", "transmit")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		source := filepath.Join(dir, "striped")
+		assert.NoError(t, ioutil.WriteFile(source, content, 0644))
+		file, err := os.Open(source)
+		assert.NoError(t, err)
+		defer file.Close()
+
+		// Without markers, the whole file is sent
+		markers := filepath.Join(dir, "striped.markers")
+		assert.NoError(t, f.ResumeStor("striped", file, markers))
+
+		// The server keeps what it received in the ranges
+		// recorded by an interrupted transfer
+		expected := append([]byte(nil), content...)
+		copy(expected[30000:40000], make([]byte, 10000))
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(expected)))
+		assert.NoError(t, ioutil.WriteFile(markers, []byte("0-40000"), 0644))
+
+		assert.NoError(t, f.ResumeStor("striped", file, markers))
+
+		assertRetr(t, f, "striped", expected)
+
+		_, err = os.Stat(markers)
+		assert.True(t, os.IsNotExist(err), "markers not removed")
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestEret(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+		resp, err := f.Eret("striped", 1000, 50*1000)
+		assert.NoError(t, err)
+		buf, err := ioutil.ReadAll(resp)
 		assert.NoError(t, err)
-		break
+		assert.True(t, bytes.Equal(content[1000:51000], buf), "received data differs")
+		assert.NoError(t, resp.Close())
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestPerfMarkers(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.PerfInterval = time.Millisecond
 	}
 
-	assert.NoError(t, s.Shutdown())
+	runServerWith(t, configure, func(network transport.Transport) {
+		var markers []ftp.PerfMarker
+		f := dial(t, network, ftp.DialWithParallelism(4), ftp.DialWithPerfMarkers(func(marker ftp.PerfMarker) {
+			markers = append(markers, marker)
+		}))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		// The final markers of each stripe add up to the whole file
+		transferred := func() uint64 {
+			final := make(map[int]uint64)
+			for _, marker := range markers {
+				assert.EqualValues(t, 4, marker.StripeCount)
+				final[marker.StripeIndex] = marker.StripeBytes
+			}
+
+			var total uint64
+			for _, bytes := range final {
+				total += bytes
+			}
+			return total
+		}
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+		assert.EqualValues(t, len(content), transferred())
+
+		markers = nil
+		assertRetr(t, f, "striped", content)
+		assert.EqualValues(t, len(content), transferred())
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestChecksums(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithParallelism(4), ftp.DialWithChecksums(true))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+		assertRetr(t, f, "striped", content)
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+// hashDriver claims to keep the same hash for every file
+type hashDriver struct {
+	server.Driver
+	hash string
+}
+
+func (driver hashDriver) Hash(path, algorithm string, offset, length int64) (string, error) {
+	return driver.hash, nil
+}
+
+func TestChecksum(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Stor("checksum", strings.NewReader("hello world")))
+
+		hash, err := f.Checksum("checksum", "SHA-256")
+		assert.NoError(t, err)
+		assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", hash)
+
+		hash, err = f.Checksum("checksum", "md5")
+		assert.NoError(t, err)
+		assert.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", hash)
+
+		_, err = f.Checksum("checksum", "unknown")
+		assert.Error(t, err)
+
+		_, err = f.Checksum("missing", "SHA-256")
+		assert.Error(t, err)
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestHashRange(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Stor("hashed", strings.NewReader("hello world")))
+		assert.NoError(t, f.Stor("empty", strings.NewReader("")))
+		assert.NoError(t, f.Quit())
+
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+		cmd(200, "OPTS HASH SHA-256")
+
+		// The range includes the last byte, an empty range ends before it starts
+		assert.Equal(t, "SHA-256 0-10 b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 hashed",
+			cmd(213, "HASH hashed"))
+		assert.Equal(t, "SHA-256 1-0 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 empty",
+			cmd(213, "HASH empty"))
+
+		cmd(221, "QUIT")
+	})
+}
+
+func TestVerify(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithParallelism(4), ftp.DialWithVerify("sha-256"))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+
+		content := testContent()
+
+		// Hashed after the transfer, and while sending
+		assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+		assert.NoError(t, f.Stor("streamed", ioutil.NopCloser(bytes.NewReader(content))))
+
+		assertRetr(t, f, "streamed", content)
+
+		file, err := ioutil.TempFile("", "transmit")
+		assert.NoError(t, err)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		assert.NoError(t, f.RetrToFile("striped", file))
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	configure := wrapFactory(func(driver server.Driver) server.Driver {
+		return hashDriver{driver, "0000"}
+	})
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithVerify("sha-256"))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+
+		hash, err := f.Checksum("stored", "SHA-256")
+		assert.NoError(t, err)
+		assert.Equal(t, "0000", hash)
+
+		err = f.Stor("stored", strings.NewReader("hello world"))
+		assert.EqualError(t, err, "checksum mismatch for stored: "+
+			"local b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9, remote 0000")
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestThirdPartyCopy(t *testing.T) {
+	const otherHost = "other"
+
+	// Each server connects to the other one
+	configure := func(opt *server.ServerOpts) {
+		opt.ThirdPartyHosts = []string{serverHost, otherHost}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		opt, cleanup := serverOpts(t, network)
+		defer cleanup()
+		opt.Hostname = otherHost
+		configure(opt)
+
+		other := server.NewServer(opt)
+		go func() {
+			err := other.ListenAndServe()
+			assert.EqualError(t, err, server.ErrServerClosed.Error())
+		}()
+		defer func() { assert.NoError(t, other.Shutdown()) }()
+
+		content := testContent()
+
+		parallel := ftp.DialWithParallelism(4)
+		verify := ftp.DialWithVerify("sha-256")
+
+		// Both or only one of the connections verify the copy
+		sides := [][2][]ftp.DialOption{
+			{{parallel, verify}, {parallel, verify}},
+			{{parallel, verify}, {parallel}},
+			{{parallel}, {parallel, verify}},
+		}
+
+		for _, extended := range []bool{false, true} {
+			for _, options := range sides {
+				src := dialHost(t, network, serverHost, options[0]...)
+				dst := dialHost(t, network, otherHost, options[1]...)
+
+				assert.NoError(t, src.Login("admin", "admin"))
+				assert.NoError(t, dst.Login("admin", "admin"))
+				if extended {
+					assert.NoError(t, src.Mode(mode.ExtendedBlockMode))
+					assert.NoError(t, dst.Mode(mode.ExtendedBlockMode))
+				}
+
+				assert.NoError(t, src.Stor("copied", bytes.NewReader(content)))
+				assert.NoError(t, ftp.ThirdPartyCopy(src, dst, "copied"))
+				assert.Error(t, ftp.ThirdPartyCopy(src, dst, "missing"))
+
+				assertRetr(t, dst, "copied", content)
+
+				assert.NoError(t, dst.Delete("copied"))
+				assert.NoError(t, src.Quit())
+				assert.NoError(t, dst.Quit())
+			}
+		}
+	})
+}
+
+func TestNotImplemented(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+
+		feats := cmd(211, "FEAT")
+		for _, command := range []string{"SBUF", "DCAU", "ESTO"} {
+			assert.NotContains(t, feats, command)
+		}
+
+		cmd(502, "SBUF 1048576")
+		cmd(502, "DCAU N")
+		cmd(502, "ESTO A 0 file")
+
+		cmd(221, "QUIT")
+	})
+}
+
+func TestBounce(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		listener, err := network.Listen("other:4000")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer listener.Close()
+
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+
+		// The server only connects to the client's host
+		cmd(504, "EPRT |1|other|4000|")
+		cmd(504, "PORT 10,0,0,1,15,160")
+		cmd(200, "MODE E")
+		cmd(504, "SPOR client:4000 other:4000")
+
+		cmd(221, "QUIT")
+	})
+
+	// Unless the host is allowed
+	configure := func(opt *server.ServerOpts) {
+		opt.ThirdPartyHosts = []string{"other"}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		listener, err := network.Listen("other:4000")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer listener.Close()
+
+		go func() {
+			if c, err := listener.Accept(); err == nil {
+				c.Close()
+			}
+		}()
+
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+		cmd(200, "EPRT |1|other|4000|")
+		cmd(504, "PORT 10,0,0,1,15,160")
+
+		cmd(221, "QUIT")
+	})
+}
+
+func TestProtectedThirdPartyCopy(t *testing.T) {
+	const otherHost = "other"
+
+	dir, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Both servers use the same certificate
+	certFile, keyFile, pool := writeCertificate(t, dir)
+	config := &tls.Config{RootCAs: pool, ServerName: serverHost}
+
+	configure := func(opt *server.ServerOpts) {
+		opt.TLS = true
+		opt.CertFile = certFile
+		opt.KeyFile = keyFile
+		opt.MinProtectionLevel = "P"
+		opt.ThirdPartyHosts = []string{serverHost, otherHost}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		opt, cleanup := serverOpts(t, network)
+		defer cleanup()
+		opt.Hostname = otherHost
+		configure(opt)
+
+		other := server.NewServer(opt)
+		go func() {
+			err := other.ListenAndServe()
+			assert.EqualError(t, err, server.ErrServerClosed.Error())
+		}()
+		defer func() { assert.NoError(t, other.Shutdown()) }()
+
+		content := []byte("secret")
+
+		for _, extended := range []bool{false, true} {
+			src := dialHost(t, network, serverHost, ftp.DialWithTLS(config), ftp.DialWithParallelism(2))
+			dst := dialHost(t, network, otherHost, ftp.DialWithTLS(config), ftp.DialWithParallelism(2))
+
+			assert.NoError(t, src.Login("admin", "admin"))
+			assert.NoError(t, dst.Login("admin", "admin"))
+			if extended {
+				assert.NoError(t, src.Mode(mode.ExtendedBlockMode))
+				assert.NoError(t, dst.Mode(mode.ExtendedBlockMode))
+			}
+
+			// The source server takes the role of the TLS client
+			// for the copy and of the TLS server again afterwards
+			assert.NoError(t, src.Stor("copied", bytes.NewReader(content)))
+			assert.NoError(t, ftp.ThirdPartyCopy(src, dst, "copied"))
+
+			for _, f := range []*ftp.ServerConn{src, dst} {
+				assertRetr(t, f, "copied", content)
+			}
+
+			assert.NoError(t, dst.Delete("copied"))
+			assert.NoError(t, src.Quit())
+			assert.NoError(t, dst.Quit())
+		}
+	})
+}
+
+func TestActiveMode(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithActiveMode(true), ftp.DialWithParallelism(4))
+
+		assert.NoError(t, f.Login("admin", "admin"))
+
+		content := testContent()
+
+		for _, extended := range []bool{false, true} {
+			if extended {
+				assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+			}
+
+			assert.NoError(t, f.Stor("active", bytes.NewReader(content)))
+
+			assertRetr(t, f, "active", content)
+		}
+
+		assert.NoError(t, f.Quit())
+	})
+}
+
+// policyTransport counts the connections dialed with a path policy
+type policyTransport struct {
+	transport.Transport
+	policy scion.PathPolicy
+	dialed *int32
+}
+
+func (t policyTransport) WithPathPolicy(policy scion.PathPolicy) transport.Transport {
+	t.policy = policy
+	return t
+}
+
+func (t policyTransport) Dial(local, remote string) (scion.Conn, error) {
+	if t.policy != nil {
+		atomic.AddInt32(t.dialed, 1)
+	}
+
+	return t.Transport.Dial(local, remote)
+}
+
+func TestPathPolicy(t *testing.T) {
+	var dialed int32
+	configure := func(opt *server.ServerOpts) {
+		opt.Transport = policyTransport{Transport: opt.Transport, dialed: &dialed}
+		opt.PathPolicy = scion.ShortestPath()
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		content := []byte("over the selected paths")
+
+		// Only the data connections the server dials take the
+		// paths of its policy, i.e. those in active mode
+		for _, active := range []bool{false, true} {
+			f := dial(t, network, ftp.DialWithActiveMode(active), ftp.DialWithParallelism(4))
+
+			assert.NoError(t, f.Login("admin", "admin"))
+			assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+			assert.NoError(t, f.Stor("policy", bytes.NewReader(content)))
+			assert.NoError(t, f.Quit())
+		}
+
+		assert.Equal(t, int32(4), atomic.LoadInt32(&dialed))
+	})
+}
+
+// TestStripeAddresses transfers between IPv4 hosts, which list their stripes
+// in the GridFTP form h1,h2,h3,h4,p1,p2 in the reply to SPAS and in SPOR
+func TestStripeAddresses(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.Hostname = "127.0.0.1"
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		content := testContent()
+
+		for _, active := range []bool{false, true} {
+			f := dialFrom(t, network, "127.0.0.2", "127.0.0.1", ftp.DialWithParallelism(4), ftp.DialWithActiveMode(active))
+
+			assert.NoError(t, f.Login("admin", "admin"))
+			assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+			assert.NoError(t, f.Stor("striped", bytes.NewReader(content)))
+
+			assertRetr(t, f, "striped", content)
+
+			assert.NoError(t, f.Quit())
+		}
+	})
+}
+
+// TestActiveModeLateConnect runs the client against a scripted server that
+// only connects to the client after the transfer command, as GridFTP servers
+// do. The file "silent" is never sent, the server replies 425 after a while
+func TestActiveModeLateConnect(t *testing.T) {
+	network := transport.NewMemory()
+	listener, err := network.Listen(serverHost + ":2121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	content := []byte("connected after RETR")
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := textproto.NewConn(c)
+		defer conn.Close()
+
+		conn.PrintfLine("220 Ready")
+
+		var port string
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "USER":
+				conn.PrintfLine("331 Password required")
+			case "PASS":
+				conn.PrintfLine("230 Logged in")
+			case "EPRT":
+				// |1|host|port|
+				port = strings.Split(fields[1], "|")[3]
+				conn.PrintfLine("200 Port set")
+			case "RETR":
+				conn.PrintfLine("150 Opening data connection")
+				if fields[1] == "silent" {
+					time.Sleep(200 * time.Millisecond)
+					conn.PrintfLine("425 Can't open data connection")
+					break
+				}
+
+				data, err := network.Dial(serverHost, clientHost+":"+port)
+				if !assert.NoError(t, err) {
+					return
+				}
+				data.Write(content)
+				data.Close()
+				conn.PrintfLine("226 Transfer complete")
+			case "QUIT":
+				conn.PrintfLine("221 Goodbye")
+				return
+			case "FEAT":
+				conn.PrintfLine("502 Not implemented")
+			default:
+				conn.PrintfLine("200 OK")
+			}
+		}
+	}()
+
+	f := dial(t, network, ftp.DialWithActiveMode(true), ftp.DialWithAcceptTimeout(50*time.Millisecond))
+	assert.NoError(t, f.Login("admin", "admin"))
+
+	assertRetr(t, f, "file", content)
+
+	_, err = f.Retr("silent")
+	assert.Error(t, err)
+
+	assert.NoError(t, f.Quit())
+}
+
+// dialControl opens a bare control connection to the test server and
+// waits for the greeting, cmd sends a command and checks the reply code
+func dialControl(t *testing.T, network transport.Transport) (*textproto.Conn, func(expected int, format string, args ...interface{}) string) {
+	// Retry until the server is listening
+	var conn *textproto.Conn
+	for conn == nil {
+		c, err := network.Dial(clientHost, serverHost+":2121")
+		if err == nil {
+			conn = textproto.NewConn(c)
+		}
+	}
+
+	cmd := func(expected int, format string, args ...interface{}) string {
+		_, err := conn.Cmd(format, args...)
+		assert.NoError(t, err)
+		_, message, err := conn.ReadResponse(expected)
+		assert.NoError(t, err)
+		return message
+	}
+
+	_, _, err := conn.ReadResponse(220)
+	assert.NoError(t, err)
+
+	return conn, cmd
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.AcceptTimeout = 50 * time.Millisecond
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+
+		// The client never connects to the passive ports
+		cmd(229, "EPSV")
+		cmd(425, "LIST")
+
+		cmd(200, "MODE E")
+		cmd(229, "SPAS")
+		cmd(425, "STOR striped")
+
+		cmd(221, "QUIT")
+	})
+}
+
+// TestDataConnMode makes sure that transfers only use data connections set
+// up for the current mode, a striped one can't be used in stream mode
+func TestDataConnMode(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+
+		cmd(503, "SPAS")
+		cmd(503, "SPOR client:40000")
+
+		cmd(200, "MODE E")
+		reply := cmd(229, "SPAS")
+		for _, line := range strings.Split(reply, "\n") {
+			if !strings.HasPrefix(line, " ") {
+				continue
+			}
+
+			data, err := network.Dial(clientHost, strings.TrimSpace(line))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer data.Close()
+		}
+
+		// Closes the striped data connections
+		cmd(200, "MODE S")
+		cmd(425, "LIST")
+		cmd(425, "STOR file")
+
+		cmd(221, "QUIT")
+	})
+}
+
+// writeCertificate writes a self-signed certificate for the test
+// server and its key to dir, the pool contains the certificate
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: serverHost},
+		DNSNames:              []string{serverHost},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, pool
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, pool := writeCertificate(t, dir)
+
+	content := testContent()
+
+	for _, explicit := range []bool{false, true} {
+		configure := func(opt *server.ServerOpts) {
+			opt.TLS = true
+			opt.CertFile = certFile
+			opt.KeyFile = keyFile
+			opt.ExplicitFTPS = explicit
+		}
+
+		runServerWith(t, configure, func(network transport.Transport) {
+			config := &tls.Config{RootCAs: pool}
+			option := ftp.DialWithTLS(config)
+			if explicit {
+				option = ftp.DialWithExplicitTLS(config)
+
+				// Logging in requires TLS
+				f := dial(t, network)
+				assert.Error(t, f.Login("admin", "admin"))
+				assert.NoError(t, f.Quit())
+
+				// Also when ignoring the reply to USER
+				conn, cmd := dialControl(t, network)
+				cmd(534, "USER admin")
+				cmd(534, "PASS admin")
+				cmd(530, "PWD")
+				cmd(221, "QUIT")
+				conn.Close()
+			}
+
+			f := dial(t, network, option, ftp.DialWithParallelism(4))
+			assert.NoError(t, f.Login("admin", "admin"))
+
+			for _, extended := range []bool{false, true} {
+				if extended {
+					assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+				}
+
+				assert.NoError(t, f.Stor("secured", bytes.NewReader(content)))
+
+				assertRetr(t, f, "secured", content)
+			}
+
+			assert.NoError(t, f.Quit())
+		})
+	}
+}
+
+func TestMinProtectionLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, pool := writeCertificate(t, dir)
+	config := &tls.Config{RootCAs: pool}
+
+	configure := func(opt *server.ServerOpts) {
+		opt.TLS = true
+		opt.CertFile = certFile
+		opt.KeyFile = keyFile
+		opt.MinProtectionLevel = "P"
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		// PROT C is refused
+		f := dial(t, network, ftp.DialWithTLS(config), ftp.DialWithClearData(true))
+		assert.Error(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Quit())
+
+		f = dial(t, network, ftp.DialWithTLS(config), ftp.DialWithParallelism(2))
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+		assert.NoError(t, f.Stor("secured", bytes.NewReader([]byte("secret"))))
+		assert.NoError(t, f.Quit())
+	})
+
+	// Unknown levels are refused rather than guessed
+	opt, cleanup := serverOpts(t, transport.NewMemory())
+	defer cleanup()
+	opt.MinProtectionLevel = "X"
+	assert.Error(t, server.NewServer(opt).ListenAndServe())
+
+	// Without TLS, data connections can't be protected at all
+	runServerWith(t, func(opt *server.ServerOpts) { opt.MinProtectionLevel = "P" }, func(network transport.Transport) {
+		f := dial(t, network)
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.Error(t, f.Stor("clear", bytes.NewReader([]byte("secret"))))
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestAccessControl(t *testing.T) {
+	acl, err := server.NewACL("allow 1-ff00:0:110 STOR\ndeny * STOR\ndeny 2-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configure := func(opt *server.ServerOpts) {
+		opt.ACL = acl
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		dialFrom := func(local string) (*ftp.ServerConn, error) {
+			return ftp.Dial(local, serverHost+":2121", ftp.DialWithTransport(network))
+		}
+
+		// Clients without SCION address may read only
+		f := dial(t, network)
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.Error(t, f.Stor("denied", bytes.NewReader([]byte("data"))))
+		assert.NoError(t, f.Quit())
+
+		f, err := dialFrom("1-ff00:0:110,[127.0.0.1]")
+		assert.NoError(t, err)
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Stor("allowed", bytes.NewReader([]byte("data"))))
+		assert.NoError(t, f.Quit())
+
+		_, err = dialFrom("2-ff00:0:210,[127.0.0.1]")
+		assert.Error(t, err)
+
+		assert.NoError(t, acl.Reload("deny * STOR"))
+
+		f, err = dialFrom("2-ff00:0:210,[127.0.0.1]")
+		assert.NoError(t, err)
+		assert.NoError(t, f.Login("admin", "admin"))
+		_, err = f.List("/")
+		assert.NoError(t, err)
+		assert.NoError(t, f.Quit())
+	})
+}
+
+func TestPrincipal(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.Auth = server.MultiAuth{
+			"admin": {Password: "admin"},
+			"alice": {Password: "alice", Principal: server.Principal{HomeDir: "alice", Quota: 100}},
+			"bob":   {Password: "bob", Principal: server.Principal{HomeDir: "/bob", ReadOnly: true}},
+			"carol": {Password: "carol", Principal: server.Principal{HomeDir: "/alice", Commands: []string{"LIST"}}},
+		}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		login := func(user string) *ftp.ServerConn {
+			f := dial(t, network)
+			if !assert.NoError(t, f.Login(user, user)) {
+				t.FailNow()
+			}
+			return f
+		}
+
+		f := login("alice")
+		assert.NoError(t, f.Stor("a", bytes.NewReader(make([]byte, 60))))
+		assert.Error(t, f.Stor("b", bytes.NewReader(make([]byte, 60))))
+		// Overwritten content doesn't count
+		assert.NoError(t, f.Stor("a", bytes.NewReader(make([]byte, 90))))
+		entries, err := f.List("/")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+		assert.Error(t, f.Stor("c", bytes.NewReader(make([]byte, 200))))
+		assert.NoError(t, f.Quit())
+
+		// The home directory is the root
+		f = login("admin")
+		size, err := f.FileSize("/alice/a")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(90), size)
+		assert.NoError(t, f.Quit())
+
+		f = login("bob")
+		_, err = f.Retr("/../alice/a")
+		assert.Error(t, err)
+		assert.Error(t, f.Stor("a", bytes.NewReader([]byte("data"))))
+		assert.Error(t, f.MakeDir("dir"))
+		assert.NoError(t, f.Quit())
+
+		f = login("carol")
+		entries, err = f.List("/")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		_, err = f.Retr("a")
+		assert.Error(t, err)
+		assert.NoError(t, f.Quit())
+	})
+}
+
+// delayedReader returns its data only after the delay
+type delayedReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *delayedReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	r.delay = 0
+	return r.Reader.Read(p)
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	configure := func(opt *server.ServerOpts) {
+		opt.Auth = server.MultiAuth{
+			"alice": {Password: "alice", Principal: server.Principal{HomeDir: "alice", Quota: 100}},
+		}
+	}
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		login := func() *ftp.ServerConn {
+			f := dial(t, network)
+			if !assert.NoError(t, f.Login("alice", "alice")) {
+				t.FailNow()
+			}
+			return f
+		}
+		f, g := login(), login()
+
+		// Each upload fits into the quota, but not both. The second
+		// one starts while the first is still running
+		errs := make(chan error)
+		go func() {
+			errs <- f.Stor("a", &delayedReader{bytes.NewReader(make([]byte, 60)), 200 * time.Millisecond})
+		}()
+		time.Sleep(50 * time.Millisecond)
+		go func() {
+			errs <- g.Stor("b", bytes.NewReader(make([]byte, 60)))
+		}()
+
+		failed := 0
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				failed++
+			}
+		}
+		assert.Equal(t, 1, failed)
+
+		assert.NoError(t, f.Quit())
+		assert.NoError(t, g.Quit())
+	})
+}
+
+func TestRestartRangesUnsupported(t *testing.T) {
+	runServer(t, func(network transport.Transport) {
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+		cmd(200, "MODE E")
+
+		// The file driver only reads and writes files from an offset
+		cmd(350, "REST 0-100")
+		cmd(504, "RETR file")
+		cmd(350, "REST 0-100")
+		cmd(504, "STOR file")
+
+		cmd(221, "QUIT")
+	})
+}
+
+func TestRestartRangesModeSwitch(t *testing.T) {
+	content := []byte("restarted in stream mode")
+
+	runServer(t, func(network transport.Transport) {
+		f := dial(t, network)
+		assert.NoError(t, f.Login("admin", "admin"))
+		assert.NoError(t, f.Stor("file", bytes.NewReader(content)))
+		assert.NoError(t, f.Quit())
+
+		conn, cmd := dialControl(t, network)
+		defer conn.Close()
+
+		cmd(331, "USER admin")
+		cmd(230, "PASS admin")
+
+		// The restart ranges don't apply in stream mode
+		cmd(200, "MODE E")
+		cmd(350, "REST 0-100")
+		cmd(200, "MODE S")
+
+		var port int
+		_, err := fmt.Sscanf(cmd(229, "PASV"), "Entering Extended Passive Mode (|||%d|)", &port)
+		assert.NoError(t, err)
+		data, err := network.Dial(clientHost, transport.JoinHostPort(serverHost, port))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		cmd(150, "RETR file")
+		received, err := ioutil.ReadAll(data)
+		assert.NoError(t, err)
+		assert.Equal(t, content, received)
+		_, _, err = conn.ReadResponse(226)
+		assert.NoError(t, err)
+
+		cmd(221, "QUIT")
+	})
+}
+
+// failingDriver fails reading files after the first bytes
+type failingDriver struct {
+	server.Driver
+}
+
+func (driver failingDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	data := io.MultiReader(bytes.NewReader(make([]byte, 100)), errReader{errors.New("disk failure")})
+	return 1000, ioutil.NopCloser(data), nil
+}
+
+// errReader fails every read with its error
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestRetrFailure(t *testing.T) {
+	configure := wrapFactory(func(driver server.Driver) server.Driver {
+		return failingDriver{driver}
+	})
+
+	runServerWith(t, configure, func(network transport.Transport) {
+		f := dial(t, network, ftp.DialWithParallelism(2))
+		assert.NoError(t, f.Login("admin", "admin"))
+
+		for _, extended := range []bool{false, true} {
+			if extended {
+				assert.NoError(t, f.Mode(mode.ExtendedBlockMode))
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+
+				resp, err := f.Retr("file")
+				if !assert.NoError(t, err) {
+					return
+				}
+				ioutil.ReadAll(resp)
+				assert.Error(t, resp.Close())
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("client blocked after the transfer failed")
+			}
+
+			// The session is still usable
+			_, err := f.CurrentDir()
+			assert.NoError(t, err)
+		}
+
+		assert.NoError(t, f.Quit())
+	})
 }
@@ -0,0 +1,212 @@
+package socket
+
+import (
+	"sort"
+	"time"
+)
+
+// Adaptive configures a WriterSocket to adjust the length of
+// segments and the number of streams in use to the throughput
+// and round trip time measured on each stream. Both are measured
+// from acknowledgements, see WriterSocket.SetAcknowledge. Without
+// them, segments have the length given to NewWriterSocket and
+// all streams are used
+type Adaptive struct {
+	// Bounds of the segment length, sending starts
+	// with the minimum length
+	MinChunkLength int
+	MaxChunkLength int
+
+	// If set, streams that are considerably slower than the
+	// fastest one only send a segment once in a while, to keep
+	// their measurements up to date. They would otherwise hold
+	// back the receiver, which has to reassemble the data in order
+	AdaptStreams bool
+
+	// The number of streams that are used in any case if
+	// AdaptStreams is set, defaults to 1
+	MinStreams int
+}
+
+var (
+	// How often the measurements are evaluated
+	AdaptInterval = 100 * time.Millisecond
+
+	// How often an inactive stream sends a segment
+	ProbeInterval = time.Second
+)
+
+const (
+	// A stream is considered slow if sending a segment over it
+	// takes this many times longer than over the fastest stream
+	slowFactor = 4
+
+	// Segments should take at least this long to be sent,
+	// otherwise the per-segment overhead dominates
+	minSegmentDuration = time.Millisecond
+)
+
+// SetAdaptive enables the adaptation of the segment length, the length
+// given to NewWriterSocket is ignored. It has to be set before the first write
+func (s *WriterSocket) SetAdaptive(adaptive Adaptive) {
+	if adaptive.MinChunkLength < 1 {
+		adaptive.MinChunkLength = 1
+	}
+	if adaptive.MaxChunkLength < adaptive.MinChunkLength {
+		adaptive.MaxChunkLength = adaptive.MinChunkLength
+	}
+	if adaptive.MinStreams < 1 {
+		adaptive.MinStreams = 1
+	}
+
+	s.adaptive = &adaptive
+	s.chunkLength = adaptive.MinChunkLength
+}
+
+// ChunkLength returns the current length of segments
+func (s *WriterSocket) ChunkLength() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.chunkLength
+}
+
+func (s *WriterSocket) adapt() {
+	ticker := time.NewTicker(AdaptInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		s.mu.Lock()
+		if s.done {
+			s.mu.Unlock()
+			return
+		}
+
+		s.adjust(now.Sub(last))
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		last = now
+	}
+}
+
+// adjust updates the measurements of the last interval and, if enabled,
+// derives the segment length and the streams in use from them. A segment should take
+// about an eighth of the round trip time to be sent, so that a failed stream
+// only needs to resend little data and the receiver doesn't need to buffer
+// much to reassemble the data in order.
+// Has to be called while holding the lock
+func (s *WriterSocket) adjust(interval time.Duration) {
+	var streams []*writeStream
+	for _, stream := range s.streams {
+		if stream.failed {
+			continue
+		}
+
+		// Inactive streams only send a probe now and then,
+		// which says nothing about their throughput
+		if stream.active && stream.ackedBytes > 0 {
+			sample := float64(stream.ackedBytes) / interval.Seconds()
+			if stream.throughput == 0 {
+				stream.throughput = sample
+			} else {
+				stream.throughput = 0.75*stream.throughput + 0.25*sample
+			}
+		}
+		stream.ackedBytes = 0
+
+		streams = append(streams, stream)
+	}
+
+	if s.adaptive == nil || len(streams) == 0 {
+		return
+	}
+
+	if s.adaptive.AdaptStreams {
+		s.selectStreams(streams)
+	}
+
+	var throughput float64
+	var rtt time.Duration
+	active := 0
+	for _, stream := range streams {
+		if stream.active && stream.throughput > 0 {
+			throughput += stream.throughput
+			rtt += stream.minRTT
+			active++
+		}
+	}
+
+	if active == 0 {
+		return
+	}
+
+	duration := rtt / time.Duration(active) / 8
+	if duration < minSegmentDuration {
+		duration = minSegmentDuration
+	}
+
+	target := int(throughput / float64(active) * duration.Seconds())
+
+	// Change gradually, the throughput measured with
+	// short segments might be limited by their overhead
+	if target > 2*s.chunkLength {
+		target = 2 * s.chunkLength
+	}
+	if target < s.chunkLength/2 {
+		target = s.chunkLength / 2
+	}
+
+	if target < s.adaptive.MinChunkLength {
+		target = s.adaptive.MinChunkLength
+	}
+	if target > s.adaptive.MaxChunkLength {
+		target = s.adaptive.MaxChunkLength
+	}
+
+	s.chunkLength = target
+}
+
+// selectStreams deactivates the streams over which a segment takes
+// considerably longer to arrive than over the fastest stream.
+// Has to be called while holding the lock
+func (s *WriterSocket) selectStreams(streams []*writeStream) {
+	delay := func(stream *writeStream) time.Duration {
+		if stream.throughput == 0 {
+			return stream.minRTT
+		}
+
+		transmission := float64(s.chunkLength) / stream.throughput
+		return stream.minRTT + time.Duration(transmission*float64(time.Second))
+	}
+
+	// Streams without measurements are kept active
+	var measured []*writeStream
+	for _, stream := range streams {
+		if stream.minRTT == 0 {
+			stream.active = true
+		} else {
+			measured = append(measured, stream)
+		}
+	}
+
+	sort.Slice(measured, func(i, j int) bool {
+		return delay(measured[i]) < delay(measured[j])
+	})
+
+	for i, stream := range measured {
+		stream.active = i < s.adaptive.MinStreams ||
+			delay(stream) <= slowFactor*delay(measured[0])
+	}
+}
+
+// shouldSend reports whether the stream may take the next segment.
+// Has to be called while holding the lock
+func (s *WriterSocket) shouldSend(stream *writeStream) bool {
+	if stream.active || s.adaptive == nil {
+		return true
+	}
+
+	return time.Since(stream.lastSent) >= ProbeInterval
+}
@@ -23,10 +23,54 @@ func (MultiSocket) Port() int {
 	return 9999
 }
 
+// A MultiSocket is used either for reading or for writing,
+// only the writing end needs to signal the end of data
 func (m *MultiSocket) Close() error {
+	if m.ReaderSocket.dispatched {
+		return m.ReaderSocket.Close()
+	}
+
 	return m.WriterSocket.Close()
 }
 
+// Transferred returns the number of bytes transferred over each
+// stream, either received or sent, see ReaderSocket.Transferred
+func (m *MultiSocket) Transferred() []uint64 {
+	if transferred := m.ReaderSocket.Transferred(); len(transferred) > 0 {
+		return transferred
+	}
+
+	return m.WriterSocket.Transferred()
+}
+
+// SetRedial configures the MultiSocket to dial a replacement
+// whenever a sub-socket fails, see WriterSocket.SetRedial
+func (m *MultiSocket) SetRedial(redial func() (DataSocket, error)) {
+	m.ReaderSocket.SetRedial(redial)
+	m.WriterSocket.SetRedial(redial)
+}
+
+// SetAcknowledge configures both ends of the MultiSocket
+// to use acknowledgements, see WriterSocket.SetAcknowledge
+func (m *MultiSocket) SetAcknowledge(enabled bool) {
+	m.ReaderSocket.SetAcknowledge(enabled)
+	m.WriterSocket.SetAcknowledge(enabled)
+}
+
+// SetChecksums configures both ends of the MultiSocket
+// to use checksums, see WriterSocket.SetChecksums
+func (m *MultiSocket) SetChecksums(enabled bool) {
+	m.ReaderSocket.SetChecksums(enabled)
+	m.WriterSocket.SetChecksums(enabled)
+}
+
+// SetAccept configures the MultiSocket to accept replacements
+// for failed sub-sockets, see WriterSocket.SetAccept
+func (m *MultiSocket) SetAccept(accept func() (DataSocket, error), stop func()) {
+	m.ReaderSocket.SetAccept(accept, stop)
+	m.WriterSocket.SetAccept(accept, stop)
+}
+
 var _ DataSocket = &MultiSocket{}
 
 func NewMultiSocket(sockets []DataSocket, maxLength int) *MultiSocket {
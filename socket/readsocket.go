@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/scionproto/scion/go/lib/log"
@@ -11,23 +12,87 @@ import (
 	"github.com/elwin/transmit/striping"
 )
 
+// BufferSize is the default number of bytes a ReaderSocket buffers to
+// reassemble the data in order, see SetBufferSize
+var BufferSize = 16 << 20
+
 type ReaderSocket struct {
 	sockets    []DataSocket
-	queue      *striping.SegmentQueue
-	written    uint64
-	eodc       int
-	finished   int // Might need mutex
 	dispatched bool
+	remaining  []byte // Part of the last segment that didn't fit into p
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	queue       *striping.SegmentQueue // Segments waiting to be read in order
+	written     uint64
+	buffered    int // Bytes in the queue
+	bufferSize  int
+	waiting     []uint64 // Offsets of the segments waiting for space
+	eodc        int
+	finished    int  // Streams that sent the end of data or failed
+	receivedEOD bool // At least one stream sent the end of data
+	live        int
+	redialing   int
+	lastFailure time.Time
+	closed      bool
+	acknowledge bool            // Acknowledge segments, see SetAcknowledge
+	checksums   bool            // Verify segments, see SetChecksums
+	err         error           // Aborts the transfer
+	transferred []uint64        // Bytes received per stream, see Transferred
+	corrupted   striping.Ranges // Claimed by segments that failed their checksum
+
+	// Set by CopyTo, the segments are written
+	// at their offset instead of being queued
+	sink     io.WriterAt
+	received striping.Ranges // Written to the sink, see Resume
+	writing  map[uint64]bool // Offsets being written to the sink
+	end      uint64          // End of the data written to the sink
+
+	replacements
 }
 
 var _ io.Reader = &ReaderSocket{}
 
 func NewReadsocket(sockets []DataSocket) *ReaderSocket {
-	return &ReaderSocket{
-		sockets: sockets,
-		queue:   striping.NewSegmentQueue(),
-		eodc:    -1,
+	s := &ReaderSocket{
+		sockets:    sockets,
+		queue:      striping.NewSegmentQueue(),
+		bufferSize: BufferSize,
+		eodc:       -1,
 	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// SetAcknowledge makes the receiver acknowledge each segment, which lets
+// the sender resend the segments of a failed stream over the remaining
+// ones. This is not part of GridFTP, both ends have to agree on it.
+// It has to be set before the first read
+func (s *ReaderSocket) SetAcknowledge(enabled bool) {
+	s.acknowledge = enabled
+}
+
+// SetChecksums makes the receiver verify the checksum that follows the
+// header of each segment, see striping.Segment.Checksum. With
+// acknowledgements, a corrupted segment fails its stream, so that the
+// sender resends it over the remaining streams. Otherwise it is dropped and
+// the transfer fails with the range it claims to cover, which is missing
+// from Received. Both ends have to agree on it. It has to be set before
+// the first read
+func (s *ReaderSocket) SetChecksums(enabled bool) {
+	s.checksums = enabled
+}
+
+// SetBufferSize limits the memory used to reassemble the data in order.
+// Once the limit is reached, streams that are ahead of the others stop
+// receiving until the data has been read, which eventually makes the
+// sender hold back. If the data that is read next is stuck behind the
+// waiting segments, the transfer fails rather than exceeding the limit,
+// see push. A segment longer than the limit fails its stream.
+// It has to be set before the first read
+func (s *ReaderSocket) SetBufferSize(size int) {
+	s.bufferSize = size
 }
 
 func (s *ReaderSocket) Read(p []byte) (n int, err error) {
@@ -37,88 +102,540 @@ func (s *ReaderSocket) Read(p []byte) (n int, err error) {
 		s.dispatchReader()
 	}
 
-	// Potential race condition?
-	// No, because the reader push segments on the queue
-	// before they increase the finished count
-	if s.finished == s.eodc && s.queue.Len() == 0 {
-		return 0, io.EOF
+	if len(s.remaining) > 0 {
+		n = copy(p, s.remaining)
+		s.remaining = s.remaining[n:]
+		return n, nil
 	}
 
-	for s.queue.Len() == 0 ||
-		s.queue.Peek().OffsetCount > s.written {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		// Segments that were sent again after a stream
+		// failed might arrive twice
+		for s.queue.Len() > 0 && s.queue.Peek().OffsetCount < s.written {
+			s.buffered -= int(s.queue.Pop().ByteCount)
+		}
+
+		if s.queue.Len() > 0 && s.queue.Peek().OffsetCount == s.written {
+			break
+		}
+
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		// Corrupted segments are not sent again
+		if s.corrupted.Contains(s.written, s.written+1) {
+			return 0, s.missing(s.written)
+		}
+
+		// Each stream sends the end of data after its
+		// segments, hence there is nothing left to wait for
+		finished := s.complete()
+		if finished && s.queue.Len() == 0 {
+			return 0, io.EOF
+		}
+
+		if finished {
+			return 0, s.missing(s.written)
+		}
+
+		if s.unavailable() {
+			return 0, fmt.Errorf("all data streams failed")
+		}
+
 		// Wait until there is a suitable segment
-		time.Sleep(time.Millisecond * 10)
+		s.cond.Wait()
 	}
 
 	next := s.queue.Pop()
 	s.written += next.ByteCount
+	s.buffered -= int(next.ByteCount)
+
+	// Streams waiting for space in the buffer might continue
+	s.cond.Broadcast()
+
+	n = copy(p, next.Data)
+	s.remaining = next.Data[n:]
+
+	return n, nil
+}
+
+// Resume sets the ranges that have been received by an earlier, interrupted
+// transfer. The sender only sends the missing ones, CopyTo considers the data
+// complete once they are filled in. It has to be set before calling CopyTo
+func (s *ReaderSocket) Resume(received striping.Ranges) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received = append(striping.Ranges(nil), received...)
+	if len(received) > 0 {
+		s.end = received[len(received)-1].End
+	}
+}
+
+// Received returns the ranges of the data that have been received,
+// as reported in restart markers. Read only receives data in order
+func (s *ReaderSocket) Received() striping.Ranges {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// If copy copies less then the ByteCount we have a problem
-	return copy(p, next.Data), nil
+	if s.sink == nil {
+		return striping.Ranges{}.Add(0, s.written)
+	}
 
+	return append(striping.Ranges(nil), s.received...)
+}
+
+// CopyTo receives all data and writes each segment at its offset as soon as
+// it arrives, which avoids buffering segments to reassemble the data in order.
+// It returns the number of bytes written and must not be mixed with Read
+func (s *ReaderSocket) CopyTo(w io.WriterAt) (int64, error) {
+	if s.dispatched {
+		return 0, fmt.Errorf("already reading from the socket")
+	}
+
+	s.mu.Lock()
+	s.sink = w
+	s.writing = make(map[uint64]bool)
+	s.mu.Unlock()
+
+	s.dispatched = true
+	s.dispatchReader()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.err != nil {
+			return int64(s.written), s.err
+		}
+
+		if s.complete() {
+			if missing := s.received.Missing(0, s.end); len(missing) > 0 {
+				return int64(s.written), s.missing(missing[0].Start)
+			}
+
+			return int64(s.written), nil
+		}
+
+		if s.unavailable() {
+			return int64(s.written), fmt.Errorf("all data streams failed")
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// Close closes all sub-sockets, there is nothing
+// to signal to the sender
+func (s *ReaderSocket) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	sockets := s.sockets
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.stopAccepting()
+
+	for _, subSocket := range sockets {
+		subSocket.Close()
+	}
+
+	return nil
 }
 
 func (s *ReaderSocket) dispatchReader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, subSocket := range s.sockets {
-		go s.receiveOnSocket(subSocket)
+		s.live++
+		s.transferred = append(s.transferred, 0)
+		go s.receiveOnSocket(subSocket, len(s.transferred)-1)
+	}
+
+	if s.accept != nil {
+		go s.acceptReplacements(s.replace)
 	}
 }
 
-func (s *ReaderSocket) receiveOnSocket(socket DataSocket) {
+// replace starts receiving on a stream that replaces a failed one
+func (s *ReaderSocket) replace(socket DataSocket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		socket.Close()
+		return
+	}
+
+	s.sockets = append(s.sockets, socket)
+	s.live++
+	s.transferred = append(s.transferred, 0)
+	go s.receiveOnSocket(socket, len(s.transferred)-1)
+}
+
+// Transferred returns the number of bytes received over each stream,
+// including the ones that replaced failed streams, in the order
+// the streams were added
+func (s *ReaderSocket) Transferred() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]uint64(nil), s.transferred...)
+}
+
+func (s *ReaderSocket) receiveOnSocket(socket DataSocket, index int) {
+	var received uint64
+
 	for {
 
-		seg, err := receiveNextSegment(socket)
+		seg, err := receiveNextSegment(socket, s.checksums, s.bufferSize)
 		if err != nil {
 			log.Error("Failed to receive segment", "err", err)
+			s.fail(socket)
+			return
 		}
 
-		// The EOD count header has a special format
-		// and is only used to transmit the EOD count
-		if seg.IsEODCount() {
-			s.eodc = seg.GetEODCount()
-			continue
+		// The segment is not acknowledged, hence the
+		// sender resends it if it acknowledges segments
+		corrupted := seg.ContainsFlag(striping.BlockFlagSuspectErrors)
+		if corrupted {
+			log.Error("Received corrupted segment", "offset", seg.OffsetCount, "length", seg.ByteCount)
+			if s.acknowledge {
+				s.fail(socket)
+				return
+			}
+
+			s.mu.Lock()
+			s.corrupted = s.corrupted.Add(seg.OffsetCount, seg.OffsetCount+seg.ByteCount)
+			s.mu.Unlock()
 		}
 
-		s.queue.Push(seg)
+		if seg.ByteCount > 0 && !seg.IsEODCount() && !corrupted {
+			s.mu.Lock()
+			s.transferred[index] += seg.ByteCount
+			s.mu.Unlock()
 
+			if !s.push(seg) {
+				// The socket has been closed, the data could
+				// not be written or the buffer stalled
+				socket.Close()
+				return
+			}
+
+			// Acknowledge the segment once it has been processed,
+			// so that the sender does not need to send it again
+			if s.acknowledge {
+				received++
+				err = binary.Write(socket, binary.BigEndian, received)
+				if err != nil {
+					log.Error("Failed to acknowledge segment", "err", err)
+					s.fail(socket)
+					return
+				}
+			}
+		}
+
+		// The EOD count is the number of streams that send the end
+		// of data, one of them sends it along with its end of data
+		if seg.IsEODCount() {
+			s.mu.Lock()
+			if seg.GetEODCount() > s.eodc {
+				s.eodc = seg.GetEODCount()
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}
+
+		// Nothing follows the end of data, the sender
+		// might keep the connection open for reuse though
 		if seg.ContainsFlag(striping.BlockFlagEndOfData) {
+			s.mu.Lock()
 			s.finished++
+			s.receivedEOD = true
+			s.live--
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+
+		if seg.IsClosingConnection() {
+			log.Error("Connection closed before the end of data")
+			s.fail(socket)
+			return
 		}
+	}
+}
+
+// fail stops receiving on a stream before it sent the end of data.
+// The sender resends the missing segments over the remaining streams,
+// so the stream is considered finished
+func (s *ReaderSocket) fail(socket DataSocket) {
+	socket.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	s.finished++
+	s.live--
+	s.lastFailure = time.Now()
+
+	// Without acknowledgements, the sender
+	// doesn't resend the segments that are lost
+	if !s.acknowledge && s.err == nil {
+		s.err = fmt.Errorf("data stream failed")
+	}
+
+	redial := s.redial != nil && s.acknowledge
+	if redial {
+		s.redialing++
+	}
+
+	// Read gives up if no replacement arrives in time
+	if s.accept != nil {
+		s.wakeAfter(ReplacementTimeout)
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
 
-		if seg.ContainsFlag(striping.BlockFlagSenderClosesConnection) {
-			log.Debug("Closing connection")
+	if redial {
+		replacement, err := s.redial()
+
+		s.mu.Lock()
+		s.redialing--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Error("Failed to replace data stream", "err", err)
 			return
 		}
 
+		s.replace(replacement)
+	}
+}
+
+// push adds the segment to the reorder buffer. If the buffer is full, it
+// waits until the segment fits, which stops receiving on the stream.
+// Once all streams wait while the segment that is read next is missing,
+// it might be queued behind one of the segments they wait with, e.g.
+// after it was resent. The buffer never grows beyond its size, the
+// transfer fails instead and has to be restarted for the missing
+// ranges, see Received.
+// Returns false if the socket has been closed in the meantime
+// or the transfer failed
+func (s *ReaderSocket) push(segment *striping.Segment) bool {
+	if s.sink != nil {
+		return s.writeAt(segment)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.waiting = append(s.waiting, segment.OffsetCount)
+	for !s.closed && s.err == nil && !s.admits(segment) {
+		if s.stalled() {
+			log.Error("Reorder buffer stalled", "missing", s.written)
+			s.err = fmt.Errorf("reorder buffer full: %s", s.missing(s.written))
+			s.cond.Broadcast()
+			break
+		}
+		s.cond.Wait()
+	}
+	for i, offset := range s.waiting {
+		if offset == segment.OffsetCount {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+
+	if s.closed || s.err != nil {
+		return false
 	}
+
+	// Already read, the segment was sent again after a stream failed
+	if segment.OffsetCount < s.written {
+		return true
+	}
+
+	s.queue.Push(segment)
+	s.buffered += int(segment.ByteCount)
+	s.cond.Broadcast()
+
+	return true
 }
 
-func receiveNextSegment(socket DataSocket) (*striping.Segment, error) {
+// writeAt writes the segment to the sink set by CopyTo. Segments that
+// were sent again after a stream failed are only written once.
+// Returns false if the socket has been closed or writing failed
+func (s *ReaderSocket) writeAt(segment *striping.Segment) bool {
+	s.mu.Lock()
+	if s.closed || s.err != nil {
+		s.mu.Unlock()
+		return false
+	}
+
+	start, end := segment.OffsetCount, segment.OffsetCount+segment.ByteCount
+	if s.writing[start] || s.received.Contains(start, end) {
+		s.mu.Unlock()
+		return true
+	}
+	s.writing[start] = true
+	s.mu.Unlock()
+
+	_, err := s.sink.WriteAt(segment.Data, int64(segment.OffsetCount))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.writing, start)
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+	} else {
+		s.written += segment.ByteCount
+		s.received = s.received.Add(start, end)
+		if end > s.end {
+			s.end = end
+		}
+	}
+	s.cond.Broadcast()
+
+	return err == nil
+}
+
+// admits reports whether the segment may be added to the buffer. The
+// segment that is read next is always admitted, otherwise the data
+// would never be read. It is at most as long as the buffer, see
+// receiveNextSegment.
+// Has to be called while holding the lock
+func (s *ReaderSocket) admits(segment *striping.Segment) bool {
+	if segment.OffsetCount <= s.written || s.buffered == 0 {
+		return true
+	}
+
+	return s.buffered+int(segment.ByteCount) <= s.bufferSize
+}
+
+// stalled reports whether the segment that is read next is missing while
+// all streams wait for space in the buffer and none is going to be
+// replaced, hence nothing is received anymore.
+// Has to be called while holding the lock
+func (s *ReaderSocket) stalled() bool {
+	if s.queue.Len() > 0 && s.queue.Peek().OffsetCount <= s.written {
+		return false
+	}
+
+	// Waiting for a segment that would be admitted by now
+	for _, offset := range s.waiting {
+		if offset <= s.written {
+			return false
+		}
+	}
+
+	if len(s.waiting) < s.live || s.redialing > 0 {
+		return false
+	}
+
+	return s.accept == nil || time.Since(s.lastFailure) >= ReplacementTimeout
+}
+
+// missing returns the error of a transfer that completed without the data
+// at offset, which is reported along with the corrupted segments, if any.
+// Has to be called while holding the lock
+func (s *ReaderSocket) missing(offset uint64) error {
+	if len(s.corrupted) > 0 {
+		return fmt.Errorf("corrupted segments at %s", s.corrupted)
+	}
+
+	return fmt.Errorf("missing data at offset %d", offset)
+}
+
+func (s *ReaderSocket) wakeAfter(timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+// complete reports whether all streams that are counted in the EOD count
+// sent the end of data. With acknowledgements, the sender only sends the
+// end of data once all segments have been acknowledged, so any end of
+// data will do once there are no streams left.
+// Has to be called while holding the lock
+func (s *ReaderSocket) complete() bool {
+	if s.eodc >= 0 && s.finished >= s.eodc {
+		return true
+	}
+
+	return s.acknowledge && s.receivedEOD && s.live == 0 && s.redialing == 0
+}
+
+// unavailable reports whether there is no stream left to receive
+// data from and none is going to be replaced.
+// Has to be called while holding the lock
+func (s *ReaderSocket) unavailable() bool {
+	if s.live > 0 || s.redialing > 0 {
+		return false
+	}
+
+	return s.accept == nil || time.Since(s.lastFailure) >= ReplacementTimeout
+}
+
+// receiveNextSegment reads a segment from the socket. If checksums is set,
+// the checksum follows the header of a segment with data, a segment that
+// doesn't match it is flagged as suspect. Segments longer than maxLength
+// are refused before their data is allocated
+func receiveNextSegment(socket DataSocket, checksums bool, maxLength int) (*striping.Segment, error) {
 	header := &striping.Header{}
 	err := binary.Read(socket, binary.BigEndian, header)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read header: %s", err)
 	}
 
-	if header.IsEODCount() {
+	// Header-only segments (EOD count, EOD, closing) carry no payload
+	if header.IsEODCount() || header.ByteCount == 0 {
 		return striping.NewSegmentWithHeader(header, nil), nil
-	} else {
-		data := make([]byte, header.ByteCount)
-		cur := 0
-
-		// Read all bytes
-		for {
-			n, err := socket.Read(data[cur:header.ByteCount])
-			if err != nil {
-				return nil, fmt.Errorf("failed to read payload: %s", err)
-			}
+	}
 
-			cur += n
-			if cur == int(header.ByteCount) {
-				return striping.NewSegmentWithHeader(header, data), nil
-			}
+	if header.ByteCount > uint64(maxLength) {
+		return nil, fmt.Errorf("segment of %d bytes exceeds the buffer size of %d bytes", header.ByteCount, maxLength)
+	}
+
+	var checksum uint32
+	if checksums {
+		err = binary.Read(socket, binary.BigEndian, &checksum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read checksum: %s", err)
+		}
+	}
+
+	data := make([]byte, header.ByteCount)
+	cur := 0
+
+	// Read all bytes
+	for cur < int(header.ByteCount) {
+		n, err := socket.Read(data[cur:header.ByteCount])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read payload: %s", err)
 		}
 
+		cur += n
+	}
+
+	segment := striping.NewSegmentWithHeader(header, data)
+	if checksums && segment.Checksum() != checksum {
+		segment.AddFlag(striping.BlockFlagSuspectErrors)
 	}
 
+	return segment, nil
 }
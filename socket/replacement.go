@@ -0,0 +1,46 @@
+package socket
+
+import "sync"
+
+// replacements provides new sub-sockets for the ones that failed,
+// either by dialing them or by accepting the ones dialed by the
+// remote end. Only one end of a connection is supposed to redial
+type replacements struct {
+	redial   func() (DataSocket, error)
+	accept   func() (DataSocket, error)
+	stop     func()
+	stopOnce sync.Once
+}
+
+// SetRedial configures the socket to dial a replacement whenever
+// a sub-socket fails. It has to be set before the first read or write
+func (r *replacements) SetRedial(redial func() (DataSocket, error)) {
+	r.redial = redial
+}
+
+// SetAccept configures the socket to accept replacements for failed
+// sub-sockets until the socket is closed, at which point stop is called
+// to make accept return. It has to be set before the first read or write
+func (r *replacements) SetAccept(accept func() (DataSocket, error), stop func()) {
+	r.accept = accept
+	r.stop = stop
+}
+
+func (r *replacements) acceptReplacements(add func(socket DataSocket)) {
+	for {
+		socket, err := r.accept()
+		if err != nil {
+			return
+		}
+
+		add(socket)
+	}
+}
+
+func (r *replacements) stopAccepting() {
+	r.stopOnce.Do(func() {
+		if r.stop != nil {
+			r.stop()
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package socket
+
+import (
+	"time"
+
+	"github.com/elwin/transmit/striping"
+)
+
+// Scheduler decides over which stream the next segment is sent
+type Scheduler interface {
+	// Schedule returns the index of the stream that should send the next
+	// segment of the given length, or -1 if the first stream that is ready
+	// may send it. Optionally it returns the index of a stream that sends
+	// a copy of the segment, or -1 if the segment is only sent once
+	Schedule(streams []StreamState, length int) (primary, redundant int)
+}
+
+// StreamState describes a stream as seen by a Scheduler
+type StreamState struct {
+	// The stream is ready to send, it is not blocked writing the previous segment
+	Available bool
+
+	// Bytes per second, zero if not measured yet
+	Throughput float64
+
+	// Zero if not measured yet
+	MinRTT time.Duration
+
+	// Bytes that have been sent, but not acknowledged yet
+	Unacknowledged int
+
+	// How long the stream has been writing the previous segment
+	Blocked time.Duration
+}
+
+func (state StreamState) measured() bool {
+	return state.Throughput > 0 && state.MinRTT > 0
+}
+
+// arrival estimates when a segment would arrive if sent over the stream.
+// Data beyond what fits into the path is queued at the sender
+func (state StreamState) arrival(length int) time.Duration {
+	inPath := state.Throughput * state.MinRTT.Seconds()
+	queued := float64(state.Unacknowledged) - inPath
+	if queued < 0 {
+		queued = 0
+	}
+
+	transmission := (queued + float64(length)) / state.Throughput
+
+	return state.Blocked + state.MinRTT/2 + time.Duration(transmission*float64(time.Second))
+}
+
+var _ Scheduler = &Weighted{}
+
+// Weighted sends each segment over the stream over which it is expected
+// to arrive first, given the bandwidth and the latency of each stream and
+// the data that is already queued. Compared to sending over the first stream
+// that is ready, slow streams get fewer segments, so the receiver doesn't
+// have to wait for them to reassemble the data in order.
+// Until all streams have been measured, segments are sent over the first
+// stream that is ready. The measurements require the receiver to
+// acknowledge segments, see WriterSocket.SetAcknowledge, otherwise the
+// scheduler is not used at all
+type Weighted struct {
+	// If set, segments that are sent over the stream with the highest
+	// latency are also sent over the stream with the lowest latency.
+	// Whichever arrives first is used, which reduces the time the
+	// receiver waits for a segment at the cost of bandwidth
+	Redundant bool
+}
+
+func (w *Weighted) Schedule(streams []StreamState, length int) (primary, redundant int) {
+	if len(streams) == 0 {
+		return -1, -1
+	}
+
+	for _, stream := range streams {
+		if !stream.measured() {
+			return -1, -1
+		}
+	}
+
+	primary = 0
+	fastest, slowest := 0, 0
+	for i, stream := range streams {
+		if stream.arrival(length) < streams[primary].arrival(length) {
+			primary = i
+		}
+		if stream.MinRTT < streams[fastest].MinRTT {
+			fastest = i
+		}
+		if stream.MinRTT > streams[slowest].MinRTT {
+			slowest = i
+		}
+	}
+
+	if w.Redundant && primary == slowest && primary != fastest &&
+		streams[slowest].MinRTT != streams[fastest].MinRTT {
+		return primary, fastest
+	}
+
+	return primary, -1
+}
+
+// SetScheduler sets the scheduler that distributes the segments over the
+// streams, by default each segment is sent over the first stream that is
+// ready. Like Adaptive, it is ignored unless segments are acknowledged.
+// It has to be set before the first write
+func (s *WriterSocket) SetScheduler(scheduler Scheduler) {
+	s.scheduler = scheduler
+}
+
+// nextSegment returns the segment the stream should send next, if any.
+// Has to be called while holding the lock
+func (s *WriterSocket) nextSegment(stream *writeStream) *striping.Segment {
+
+	// Copies of segments sent over a slow stream come first
+	if len(stream.redundant) > 0 {
+		segment := stream.redundant[0]
+		stream.redundant = stream.redundant[1:]
+		return segment
+	}
+
+	if !s.shouldSend(stream) {
+		return nil
+	}
+
+	// Segments read from the source are only created
+	// once a stream is ready to send them
+	if len(s.pending) == 0 && len(s.sourceRanges) > 0 {
+		next := &s.sourceRanges[0]
+		length := uint64(s.chunkLength)
+		if next.Start+length > next.End {
+			length = next.End - next.Start
+		}
+
+		header := striping.NewHeader(length, next.Start)
+		s.pending = append(s.pending, striping.NewSegmentWithHeader(header, nil))
+
+		next.Start += length
+		if int(next.Start) > s.written {
+			s.written = int(next.Start)
+		}
+		if next.Start == next.End {
+			s.sourceRanges = s.sourceRanges[1:]
+		}
+	}
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	segment := s.pending[0]
+
+	// Inactive streams only send a probe now and then, see
+	// Adaptive, which is not subject to scheduling
+	var primary, redundant *writeStream
+	if s.scheduler != nil && stream.active {
+		var eligible []*writeStream
+		var states []StreamState
+		for _, other := range s.streams {
+			if !other.failed && other.active {
+				eligible = append(eligible, other)
+				states = append(states, other.state())
+			}
+		}
+
+		p, r := s.scheduler.Schedule(states, int(segment.ByteCount))
+		if p >= 0 && p < len(eligible) {
+			primary = eligible[p]
+		}
+		if r >= 0 && r < len(eligible) {
+			redundant = eligible[r]
+		}
+	}
+
+	// Another stream is going to send it
+	if primary != nil && primary != stream {
+		return nil
+	}
+
+	s.pending = s.pending[1:]
+
+	if redundant != nil && redundant != stream && segment.ByteCount > 0 {
+		redundant.redundant = append(redundant.redundant, segment)
+	}
+
+	return segment
+}
+
+// Has to be called while holding the lock
+func (stream *writeStream) state() StreamState {
+	state := StreamState{
+		Available:      !stream.writing,
+		Throughput:     stream.throughput,
+		MinRTT:         stream.minRTT,
+		Unacknowledged: stream.unacknowledged,
+	}
+
+	if stream.writing {
+		state.Blocked = time.Since(stream.lastSent)
+	}
+
+	return state
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 
 	"github.com/elwin/transmit/scion"
+	"github.com/elwin/transmit/transport"
 )
 
 // DataSocket describes a data socket used to send non-control data
@@ -43,7 +44,8 @@ func (socket *ScionSocket) Close() error {
 }
 
 func (socket *ScionSocket) Host() string {
-	return socket.conn.LocalAddr().Host.String()
+	host, _, _ := transport.SplitHostPort(socket.conn.LocalAddr().String())
+	return host
 }
 
 func (socket *ScionSocket) Read(p []byte) (n int, err error) {
@@ -0,0 +1,808 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elwin/transmit/striping"
+	"github.com/elwin/transmit/transport"
+)
+
+// failingSocket breaks the connection once limit bytes have been written
+type failingSocket struct {
+	DataSocket
+	mu      sync.Mutex
+	written int
+	limit   int
+}
+
+func (s *failingSocket) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.written+len(p) > s.limit {
+		s.DataSocket.Close()
+		return 0, fmt.Errorf("connection broken")
+	}
+
+	s.written += len(p)
+	return s.DataSocket.Write(p)
+}
+
+// corruptingSocket flips a bit in the first payload that is written
+// over any of the sockets sharing once, or in the offset of the first
+// header if offset is set
+type corruptingSocket struct {
+	DataSocket
+	once   *sync.Once
+	offset bool
+}
+
+func (s *corruptingSocket) Write(p []byte) (int, error) {
+	// Headers are written separately
+	if s.offset && len(p) == 17 {
+		s.once.Do(func() {
+			p = append([]byte(nil), p...)
+			p[9] ^= 1
+		})
+	}
+
+	// Headers and checksums are written separately
+	if !s.offset && len(p) > 100 {
+		s.once.Do(func() {
+			p = append([]byte(nil), p...)
+			p[len(p)/2] ^= 1
+		})
+	}
+
+	return s.DataSocket.Write(p)
+}
+
+// stripedPairs connects n writing sockets with n reading sockets,
+// the limits set after how many bytes the writing sockets fail
+func stripedPairs(t *testing.T, limits ...int) ([]DataSocket, []DataSocket, *transport.Memory) {
+	network := transport.NewMemory()
+	listener, err := network.Listen("server:2121")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var writers, readers []DataSocket
+	for _, limit := range limits {
+		conn, err := network.Dial("client", "server:2121")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var writer DataSocket = NewScionSocket(conn, len(writers))
+		if limit > 0 {
+			writer = &failingSocket{DataSocket: writer, limit: limit}
+		}
+
+		writers = append(writers, writer)
+		readers = append(readers, NewScionSocket(accepted, len(readers)))
+	}
+
+	return writers, readers, network
+}
+
+// acknowledged enables acknowledgements on both ends,
+// which resending the segments of failed streams requires
+func acknowledged(writer *WriterSocket, reader *ReaderSocket) (*WriterSocket, *ReaderSocket) {
+	writer.SetAcknowledge(true)
+	reader.SetAcknowledge(true)
+	return writer, reader
+}
+
+// testContent returns random data of the given size,
+// the same data on every call
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(0)).Read(content)
+	return content
+}
+
+// checkTransfer fails the test unless the content has been received
+func checkTransfer(t *testing.T, content, received []byte, writeErr, readErr error) {
+	t.Helper()
+
+	if writeErr != nil || readErr != nil {
+		t.Fatalf("transfer failed: %v, %v", writeErr, readErr)
+	}
+	if !bytes.Equal(content, received) {
+		t.Errorf("received data differs")
+	}
+}
+
+func transfer(t *testing.T, writer *WriterSocket, reader *ReaderSocket, size int) ([]byte, []byte, error, error) {
+	content := testContent(size)
+
+	var received []byte
+	var readErr error
+	done := make(chan struct{})
+
+	go func() {
+		received, readErr = ioutil.ReadAll(reader)
+		reader.Close()
+		close(done)
+	}()
+
+	_, writeErr := writer.Write(content)
+	if closeErr := writer.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	<-done
+
+	return content, received, writeErr, readErr
+}
+
+func TestStriping(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+	content, received, writeErr, readErr := transfer(t,
+		NewWriterSocket(writers, 1000), NewReadsocket(readers), 100*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+}
+
+func TestTransferred(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+	writer, reader := NewWriterSocket(writers, 1000), NewReadsocket(readers)
+	content, _, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	if writeErr != nil || readErr != nil {
+		t.Fatalf("transfer failed: %v, %v", writeErr, readErr)
+	}
+
+	sent, received := writer.Transferred(), reader.Transferred()
+	if len(sent) != len(writers) || len(received) != len(readers) {
+		t.Fatalf("streams: got %d and %d, want %d", len(sent), len(received), len(writers))
+	}
+
+	// Without failures, each stream receives what was sent over it
+	var total uint64
+	for i := range sent {
+		if sent[i] != received[i] {
+			t.Errorf("stream %d: sent %d, received %d", i, sent[i], received[i])
+		}
+		total += sent[i]
+	}
+	if total != uint64(len(content)) {
+		t.Errorf("transferred: got %d, want %d", total, len(content))
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// The second stream fails after a couple of segments
+	writers, readers, _ := stripedPairs(t, 0, 10*1000, 0)
+	writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+
+	content, received, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+}
+
+func TestFailoverRedial(t *testing.T) {
+	// The only stream fails, the transfer has to continue
+	// over the replacement
+	writers, readers, network := stripedPairs(t, 10*1000)
+
+	listener, err := network.Listen("server:2122")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewWriterSocket(writers, 1000)
+	writer.SetRedial(func() (DataSocket, error) {
+		conn, err := network.Dial("client", "server:2122")
+		if err != nil {
+			return nil, err
+		}
+		return NewScionSocket(conn, 1), nil
+	})
+
+	reader := NewReadsocket(readers)
+	reader.SetAccept(func() (DataSocket, error) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return NewScionSocket(conn, 1), nil
+	}, func() { listener.Close() })
+
+	acknowledged(writer, reader)
+
+	content, received, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+}
+
+func TestFailoverAllStreams(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 10*1000, 10*1000)
+	writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+
+	_, _, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	if writeErr == nil {
+		t.Errorf("expected the writer to fail")
+	}
+	if readErr == nil {
+		t.Errorf("expected the reader to fail")
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	for _, offset := range []bool{false, true} {
+		testChecksums(t, offset)
+	}
+}
+
+// testChecksums corrupts the data or the offset of a segment
+func testChecksums(t *testing.T, offset bool) {
+	corrupted := func() ([]DataSocket, []DataSocket) {
+		writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+		once := &sync.Once{}
+		for i := range writers {
+			writers[i] = &corruptingSocket{writers[i], once, offset}
+		}
+		return writers, readers
+	}
+
+	checksums := func(writer *WriterSocket, reader *ReaderSocket) (*WriterSocket, *ReaderSocket) {
+		writer.SetChecksums(true)
+		reader.SetChecksums(true)
+		return writer, reader
+	}
+
+	// The corrupted segment is sent again over the remaining streams
+	writers, readers := corrupted()
+	writer, reader := checksums(acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers)))
+
+	content, received, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+
+	// Without acknowledgements, the transfer fails
+	// with the range the corrupted segment claims
+	writers, readers = corrupted()
+	writer, reader = checksums(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+
+	_, _, _, readErr = transfer(t, writer, reader, 100*1000+123)
+
+	if readErr == nil || !strings.Contains(readErr.Error(), "corrupted segments at") {
+		t.Errorf("expected corrupted segments, got %v", readErr)
+	}
+}
+
+func TestAdaptiveTransfer(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+	writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+	writer.SetAdaptive(Adaptive{MinChunkLength: 100, MaxChunkLength: 10 * 1000, AdaptStreams: true})
+
+	content, received, writeErr, readErr := transfer(t, writer, reader, 1000*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+}
+
+func TestAdjust(t *testing.T) {
+	fast := &writeStream{active: true, minRTT: 10 * time.Millisecond}
+	slow := &writeStream{active: true, minRTT: 200 * time.Millisecond}
+	failed := &writeStream{active: true, failed: true}
+
+	s := NewWriterSocket(nil, 1000)
+	s.SetAdaptive(Adaptive{MinChunkLength: 1000, MaxChunkLength: 100 * 1000, AdaptStreams: true})
+	s.streams = []*writeStream{fast, slow, failed}
+
+	// 10 MB/s per stream with a round trip time of 10 ms: a segment
+	// should take 1.25 ms to be sent, that is 12.5 kB. The segment
+	// length is at most doubled per interval
+	expected := []int{2000, 4000, 8000, 12500, 12500}
+	for _, length := range expected {
+		fast.ackedBytes = 1000 * 1000
+		slow.ackedBytes = 1000 * 1000
+		s.adjust(100 * time.Millisecond)
+
+		if s.chunkLength != length {
+			t.Errorf("chunk length: got %d, want %d", s.chunkLength, length)
+		}
+	}
+
+	if !fast.active || slow.active {
+		t.Errorf("expected only the stream with the shorter round trip time to be active")
+	}
+
+	// The inactive stream is only used for probing
+	s.mu.Lock()
+	slow.lastSent = time.Now()
+	if s.shouldSend(slow) || !s.shouldSend(fast) {
+		t.Errorf("expected only the active stream to send")
+	}
+	slow.lastSent = time.Now().Add(-ProbeInterval)
+	if !s.shouldSend(slow) {
+		t.Errorf("expected the inactive stream to send a probe")
+	}
+	s.mu.Unlock()
+}
+
+func TestWeighted(t *testing.T) {
+	fast := StreamState{Available: true, Throughput: 10 * 1000 * 1000, MinRTT: 10 * time.Millisecond}
+	slow := StreamState{Available: true, Throughput: 1000 * 1000, MinRTT: 100 * time.Millisecond}
+	unmeasured := StreamState{Available: true}
+
+	// 1 MB queued beyond what fits into the path takes 100 ms to be sent
+	queued := fast
+	queued.Unacknowledged = 1100 * 1000
+
+	blocked := fast
+	blocked.Available = false
+	blocked.Blocked = time.Second
+
+	tests := []struct {
+		name      string
+		scheduler *Weighted
+		streams   []StreamState
+		primary   int
+		redundant int
+	}{
+		{"unmeasured", &Weighted{}, []StreamState{fast, unmeasured}, -1, -1},
+		{"fastest", &Weighted{}, []StreamState{slow, fast}, 1, -1},
+		{"queued", &Weighted{}, []StreamState{queued, slow}, 1, -1},
+		{"blocked", &Weighted{}, []StreamState{blocked, slow}, 1, -1},
+		{"redundant fastest", &Weighted{Redundant: true}, []StreamState{slow, fast}, 1, -1},
+		{"redundant slowest", &Weighted{Redundant: true}, []StreamState{queued, slow}, 1, 0},
+	}
+
+	for _, test := range tests {
+		primary, redundant := test.scheduler.Schedule(test.streams, 1000)
+		if primary != test.primary || redundant != test.redundant {
+			t.Errorf("%s: got (%d, %d), want (%d, %d)",
+				test.name, primary, redundant, test.primary, test.redundant)
+		}
+	}
+}
+
+func TestScheduledTransfer(t *testing.T) {
+	for _, scheduler := range []*Weighted{{}, {Redundant: true}} {
+		writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+		writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+		writer.SetScheduler(scheduler)
+
+		content, received, writeErr, readErr := transfer(t, writer, reader, 1000*1000+123)
+
+		checkTransfer(t, content, received, writeErr, readErr)
+	}
+}
+
+func TestUnacknowledgedAdaptive(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0, 0)
+
+	// Nothing is measured, segments have the fixed length
+	// and are sent over the first stream that is ready
+	writer, reader := NewWriterSocket(writers, 1000), NewReadsocket(readers)
+	writer.SetAdaptive(Adaptive{MinChunkLength: 100, MaxChunkLength: 10 * 1000, AdaptStreams: true})
+	writer.SetScheduler(&Weighted{})
+
+	content, received, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+	checkTransfer(t, content, received, writeErr, readErr)
+	if writer.ChunkLength() != 1000 {
+		t.Errorf("chunk length: got %d, want %d", writer.ChunkLength(), 1000)
+	}
+	if writer.scheduler != nil {
+		t.Errorf("expected the scheduler to be ignored")
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	s := NewReadsocket(nil)
+	s.SetBufferSize(2000)
+	s.dispatched = true
+	s.live = 2
+
+	segment := func(offset int) *striping.Segment {
+		return striping.NewSegment(make([]byte, 1000), offset)
+	}
+
+	s.push(segment(1000))
+	s.push(segment(2000))
+
+	// The buffer is full, only the segment that is read next fits
+	pushed := make(chan struct{})
+	go func() {
+		s.push(segment(3000))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("expected the segment to wait for space in the buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.push(segment(0))
+
+	p := make([]byte, 1000)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Read(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the segment to be added once there is space")
+	}
+
+	if s.buffered != 2000 {
+		t.Errorf("buffered: got %d, want %d", s.buffered, 2000)
+	}
+}
+
+func TestStalledReorderBuffer(t *testing.T) {
+	s := NewReadsocket(nil)
+	s.SetBufferSize(2000)
+	s.dispatched = true
+	s.live = 1
+
+	segment := func(offset int) *striping.Segment {
+		return striping.NewSegment(make([]byte, 1000), offset)
+	}
+
+	s.push(segment(1000))
+	s.push(segment(2000))
+
+	// The only stream waits for space while the segment at offset 0
+	// is missing, the transfer fails rather than exceeding the buffer
+	if s.push(segment(3000)) {
+		t.Errorf("expected the segment to be refused")
+	}
+	if s.buffered != 2000 {
+		t.Errorf("buffered: got %d, want %d", s.buffered, 2000)
+	}
+	if _, err := s.Read(make([]byte, 1000)); err == nil {
+		t.Errorf("expected the transfer to fail")
+	}
+}
+
+func TestOversizedSegment(t *testing.T) {
+	// A header announcing more data than fits into the buffer
+	// fails the stream before the data is allocated
+	for _, length := range []string{"00000000000003e9", "ffffffffffffffff"} {
+		writers, readers, _ := stripedPairs(t, 0)
+		reader := NewReadsocket(readers)
+		reader.SetBufferSize(1000)
+
+		header, _ := hex.DecodeString("00" + length + "0000000000000000")
+		go writers[0].Write(header)
+
+		if _, err := ioutil.ReadAll(reader); err == nil {
+			t.Errorf("segment of 0x%s bytes: expected error", length)
+		}
+	}
+}
+
+func TestBoundedTransfer(t *testing.T) {
+	// Without and with a stream that fails after a couple of segments,
+	// which makes the sender resend segments out of order. A resent
+	// segment might get stuck behind the segments waiting for space,
+	// then the transfer fails rather than exceeding the buffer
+	for _, limit := range []int{0, 10 * 1000} {
+		writers, readers, _ := stripedPairs(t, 0, limit, 0)
+
+		writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+		reader.SetBufferSize(3000)
+
+		content, received, writeErr, readErr := transfer(t, writer, reader, 100*1000+123)
+
+		if limit > 0 && readErr != nil && strings.Contains(readErr.Error(), "reorder buffer full") {
+			if !bytes.HasPrefix(content, received) {
+				t.Errorf("received data differs")
+			}
+			continue
+		}
+
+		checkTransfer(t, content, received, writeErr, readErr)
+	}
+}
+
+// bufferAt is an in-memory io.WriterAt
+type bufferAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+
+	return copy(b.data[off:], p), nil
+}
+
+func TestCopyTo(t *testing.T) {
+	// Segments that are resent after the failure are only written once
+	writers, readers, _ := stripedPairs(t, 0, 10*1000, 0)
+
+	content := testContent(100*1000 + 123)
+
+	writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+	sink := &bufferAt{}
+
+	var n int64
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		n, readErr = reader.CopyTo(sink)
+		reader.Close()
+		close(done)
+	}()
+
+	_, writeErr := writer.Write(content)
+	if closeErr := writer.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	<-done
+
+	checkTransfer(t, content, sink.data, writeErr, readErr)
+	if n != int64(len(content)) {
+		t.Errorf("written: got %d, want %d", n, len(content))
+	}
+}
+
+func TestResume(t *testing.T) {
+	// Only the ranges missing after an interrupted transfer are sent
+	writers, readers, _ := stripedPairs(t, 0, 0)
+
+	content := testContent(100*1000 + 123)
+
+	received := striping.Ranges{}.Add(0, 20*1000).Add(50*1000, 60*1000+7)
+	missing := received.Missing(0, uint64(len(content)))
+
+	// The sink has zeros where the earlier transfer left off
+	sink := &bufferAt{data: make([]byte, len(content))}
+	for _, r := range received {
+		copy(sink.data[r.Start:r.End], content[r.Start:r.End])
+	}
+
+	writer := NewWriterSocket(writers, 1000)
+	reader := NewReadsocket(readers)
+	reader.Resume(received)
+
+	var n int64
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		n, readErr = reader.CopyTo(sink)
+		reader.Close()
+		close(done)
+	}()
+
+	sent, writeErr := writer.CopyRanges(bytes.NewReader(content), missing)
+	if closeErr := writer.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	<-done
+
+	checkTransfer(t, content, sink.data, writeErr, readErr)
+	if sent != int64(missing.Size()) || n != sent {
+		t.Errorf("sent %d and written %d, want %d", sent, n, missing.Size())
+	}
+
+	want := striping.Ranges{}.Add(0, uint64(len(content)))
+	if got := reader.Received(); got.String() != want.String() {
+		t.Errorf("received ranges: got %s, want %s", got, want)
+	}
+}
+
+// failingReaderAt fails to read beyond limit
+type failingReaderAt struct {
+	limit int64
+}
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.limit {
+		return 0, fmt.Errorf("read failed")
+	}
+
+	return len(p), nil
+}
+
+func TestReadFrom(t *testing.T) {
+	// The streams read the segments they send from the source, including
+	// the segments that are resent after a stream failed
+	for _, limit := range []int{0, 10 * 1000} {
+		writers, readers, _ := stripedPairs(t, 0, limit, 0)
+
+		content := testContent(100*1000 + 123)
+
+		source := bytes.NewReader(content)
+		source.Seek(1000, io.SeekStart)
+
+		writer, reader := acknowledged(NewWriterSocket(writers, 1000), NewReadsocket(readers))
+		var received []byte
+		var readErr error
+		done := make(chan struct{})
+		go func() {
+			received, readErr = ioutil.ReadAll(reader)
+			reader.Close()
+			close(done)
+		}()
+
+		n, writeErr := writer.ReadFrom(source)
+		if closeErr := writer.Close(); writeErr == nil {
+			writeErr = closeErr
+		}
+		<-done
+
+		checkTransfer(t, content[1000:], received, writeErr, readErr)
+		if n != int64(len(content)-1000) {
+			t.Errorf("sent: got %d, want %d", n, len(content)-1000)
+		}
+	}
+}
+
+func TestCopyFromFailingSource(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0)
+
+	reader := NewReadsocket(readers)
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(reader)
+		reader.Close()
+		done <- err
+	}()
+
+	writer := NewWriterSocket(writers, 1000)
+	_, writeErr := writer.CopyFrom(failingReaderAt{limit: 10 * 1000}, 0, 100*1000)
+	if closeErr := writer.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+
+	if writeErr == nil {
+		t.Errorf("expected the writer to fail")
+	}
+	if err := <-done; err == nil {
+		t.Errorf("expected the reader to fail")
+	}
+}
+
+// The framing of extended block mode as described in GFD.020, each
+// header consists of the descriptor and two 64 bit big-endian fields.
+// The streams are assembled by hand from the specification rather than
+// captured from another implementation, hence they don't show that the
+// framing interoperates with Globus
+var (
+	gfdSegments = "00" + "0000000000000004" + "0000000000000000" + "68656c6c" + // hell
+		"00" + "0000000000000004" + "0000000000000004" + "6f20776f" + // o wo
+		"00" + "0000000000000003" + "0000000000000008" + "726c64" // rld
+
+	// With checksums, the CRC32C of the header and the data follows the header
+	gfdChecksumSegments = "00" + "0000000000000004" + "0000000000000000" + "e5ec3ff6" + "68656c6c" + // hell
+		"00" + "0000000000000004" + "0000000000000004" + "6535e665" + "6f20776f" + // o wo
+		"00" + "0000000000000003" + "0000000000000008" + "f5a19edd" + "726c64" // rld
+
+	// EOD, EOF and sender closes connection, the offset is the EOD count
+	gfdEODC = "4c" + "0000000000000000" + "0000000000000002"
+
+	// EOD and sender closes connection
+	gfdEOD = "0c" + "0000000000000000" + "0000000000000000"
+)
+
+func TestBlockFramingWriter(t *testing.T) {
+	received := func(sockets []DataSocket) []chan string {
+		var streams []chan string
+		for _, socket := range sockets {
+			stream := make(chan string, 1)
+			go func(socket DataSocket) {
+				data, _ := ioutil.ReadAll(socket)
+				stream <- hex.EncodeToString(data)
+			}(socket)
+			streams = append(streams, stream)
+		}
+		return streams
+	}
+
+	// The segments are followed by the end of data, the first
+	// stream also sends the EOD count
+	writers, readers, _ := stripedPairs(t, 0)
+	streams := received(readers)
+
+	writer := NewWriterSocket(writers, 4)
+	writer.Write([]byte("hello world"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := gfdSegments + "4c" + "0000000000000000" + "0000000000000001"
+	if got := <-streams[0]; got != expected {
+		t.Errorf("got %s, want %s", got, expected)
+	}
+
+	writers, readers, _ = stripedPairs(t, 0)
+	streams = received(readers)
+
+	writer = NewWriterSocket(writers, 4)
+	writer.SetChecksums(true)
+	writer.Write([]byte("hello world"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = gfdChecksumSegments + "4c" + "0000000000000000" + "0000000000000001"
+	if got := <-streams[0]; got != expected {
+		t.Errorf("got %s, want %s", got, expected)
+	}
+
+	// Without data, each stream only sends the end of data
+	writers, readers, _ = stripedPairs(t, 0, 0)
+	streams = received(readers)
+
+	if err := NewWriterSocket(writers, 4).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-streams[0]; got != gfdEODC {
+		t.Errorf("got %s, want %s", got, gfdEODC)
+	}
+	if got := <-streams[1]; got != gfdEOD {
+		t.Errorf("got %s, want %s", got, gfdEOD)
+	}
+}
+
+func TestBlockFramingReader(t *testing.T) {
+	writers, readers, _ := stripedPairs(t, 0, 0)
+
+	// The blocks of the first stream precede the ones of the second
+	// stream, which also sends the EOD count without closing
+	streams := []string{
+		"00" + "0000000000000006" + "0000000000000000" + "68656c6c6f20" + // hello
+			gfdEOD,
+		"00" + "0000000000000005" + "0000000000000006" + "776f726c64" + // world
+			"48" + "0000000000000000" + "0000000000000002",
+	}
+
+	reader := NewReadsocket(readers)
+	done := make(chan struct{})
+	var received []byte
+	var err error
+	go func() {
+		received, err = ioutil.ReadAll(reader)
+		close(done)
+	}()
+
+	for i := len(streams) - 1; i >= 0; i-- {
+		data, _ := hex.DecodeString(streams[i])
+		if _, err := writers[i].Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "hello world" {
+		t.Errorf("got %q, want %q", received, "hello world")
+	}
+}
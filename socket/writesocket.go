@@ -2,41 +2,92 @@ package socket
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/scionproto/scion/go/lib/log"
 
 	"github.com/elwin/transmit/striping"
 )
 
+// How long to wait for a replacement stream
+// once all streams have failed
+var ReplacementTimeout = 5 * time.Second
+
 type WriterSocket struct {
-	sockets           []DataSocket
-	maxLength         int
-	segmentChannel    chan *striping.Segment
-	parent            Parent
-	child             Child
-	written           int
-	dispatchedWriters bool
+	sockets    []DataSocket
+	maxLength  int
+	dispatched bool
+
+	mu          sync.Mutex
+	written     int // Offset of the next segment
+	cond        *sync.Cond
+	chunkLength int // Current length of segments, see Adaptive
+	adaptive    *Adaptive
+	scheduler   Scheduler
+	streams     []*writeStream
+	pending     []*striping.Segment // Segments waiting to be sent
+	acknowledge bool                // The receiver acknowledges segments
+	checksums   bool                // Segments carry a checksum
+	redialing   int
+	lastFailure time.Time
+	done        bool  // All segments have been acknowledged
+	err         error // Aborts the transfer
+	writers     sync.WaitGroup
+
+	// Set by CopyRanges, the streams read the
+	// data of the segments they send by themselves
+	source       io.ReaderAt
+	sourceBase   int64           // Offset in source minus offset in the data
+	sourceRanges striping.Ranges // Not yet handed to a stream
+
+	replacements
+}
+
+// writeStream is a single sub-socket of a WriterSocket
+type writeStream struct {
+	socket    DataSocket
+	inflight  []sentSegment       // Written, but not yet acknowledged
+	redundant []*striping.Segment // Copies to send, see Weighted
+	writing   bool
+	failed    bool
+
+	transferred uint64 // Bytes sent, see Transferred
+
+	// Measurements, see Adaptive and Scheduler
+	active         bool
+	lastSent       time.Time
+	unacknowledged int
+	ackedBytes     int
+	throughput     float64 // Bytes per second
+	minRTT         time.Duration
+}
+
+type sentSegment struct {
+	*striping.Segment
+	sentAt time.Time
 }
 
 var _ io.Writer = &WriterSocket{}
+var _ io.ReaderFrom = &WriterSocket{}
 var _ io.Closer = &WriterSocket{}
 
 func NewWriterSocket(sockets []DataSocket, maxLength int) *WriterSocket {
-	parent, child := NewCoordination(len(sockets))
-
-	return &WriterSocket{
-		sockets:        sockets,
-		maxLength:      maxLength,
-		segmentChannel: make(chan *striping.Segment),
-		parent:         parent,
-		child:          child,
+	s := &WriterSocket{
+		sockets:     sockets,
+		maxLength:   maxLength,
+		chunkLength: maxLength,
 	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
 }
 
 func (s *WriterSocket) Write(p []byte) (n int, err error) {
-	if !s.dispatchedWriters {
-		s.dispatchedWriters = true
+	if !s.dispatched {
+		s.dispatched = true
 		s.dispatchWriter()
 	}
 
@@ -47,7 +98,24 @@ func (s *WriterSocket) Write(p []byte) (n int, err error) {
 			return cur, nil
 		}
 
-		to := cur + s.maxLength
+		s.mu.Lock()
+
+		// Keep at most one segment per stream waiting
+		for len(s.pending) >= s.live() && !s.unavailable() && s.err == nil {
+			s.cond.Wait()
+		}
+
+		if s.err != nil {
+			s.mu.Unlock()
+			return cur, s.err
+		}
+
+		if s.unavailable() {
+			s.mu.Unlock()
+			return cur, fmt.Errorf("all data streams failed")
+		}
+
+		to := cur + s.chunkLength
 		if to > len(p) {
 			to = len(p)
 		}
@@ -55,64 +123,482 @@ func (s *WriterSocket) Write(p []byte) (n int, err error) {
 		data := make([]byte, to-cur)
 		copy(data, p[cur:to])
 
-		s.segmentChannel <- striping.NewSegment(data, s.written)
+		s.pending = append(s.pending, striping.NewSegment(data, s.written))
+		s.written += to - cur
+		s.cond.Broadcast()
+		s.mu.Unlock()
 
-		s.written += cur - to
 		cur = to
 	}
 }
 
+// SetAcknowledge makes the sender wait for the receiver to acknowledge each
+// segment, which allows resending the segments of a failed stream over the
+// remaining ones. This is not part of GridFTP, both ends have to agree on it.
+// It has to be set before the first write
+func (s *WriterSocket) SetAcknowledge(enabled bool) {
+	s.acknowledge = enabled
+}
+
+// SetChecksums makes the sender add a checksum after the header of each
+// segment, which the receiver verifies, see ReaderSocket.SetChecksums.
+// This is not part of GridFTP, both ends have to agree on it. It has
+// to be set before the first write
+func (s *WriterSocket) SetChecksums(enabled bool) {
+	s.checksums = enabled
+}
+
+// CopyFrom sends length bytes of r, starting at offset. Rather than copying
+// the data into segments one at a time, each stream reads the segments it
+// sends from r itself, so reading and sending scale with the number of
+// streams. r must support parallel calls to ReadAt, as *os.File does.
+// Like Write, it returns once all data has been handed to the streams
+func (s *WriterSocket) CopyFrom(r io.ReaderAt, offset, length int64) (int64, error) {
+	s.mu.Lock()
+	start := uint64(s.written)
+	s.mu.Unlock()
+
+	ranges := striping.Ranges{}.Add(start, start+uint64(length))
+	return s.copyRanges(r, offset-int64(start), ranges)
+}
+
+// CopyRanges sends the given ranges of r, each segment carries its offset
+// in r. This resumes a transfer that has been interrupted, the receiver
+// reports the ranges it got in restart markers. See CopyFrom
+func (s *WriterSocket) CopyRanges(r io.ReaderAt, ranges striping.Ranges) (int64, error) {
+	return s.copyRanges(r, 0, ranges)
+}
+
+func (s *WriterSocket) copyRanges(r io.ReaderAt, base int64, ranges striping.Ranges) (int64, error) {
+	if !s.dispatched {
+		s.dispatched = true
+		s.dispatchWriter()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.source = r
+	s.sourceBase = base
+	s.sourceRanges = append(striping.Ranges(nil), ranges...)
+	s.cond.Broadcast()
+
+	for len(s.sourceRanges) > 0 && s.err == nil && !s.unavailable() {
+		s.cond.Wait()
+	}
+
+	n := int64(ranges.Size() - s.sourceRanges.Size())
+	if s.err != nil {
+		return n, s.err
+	}
+	if s.unavailable() {
+		return n, fmt.Errorf("all data streams failed")
+	}
+
+	return n, nil
+}
+
+// ReadFrom sends the remaining data of r. If r supports positional reads and
+// seeking, as *os.File does, the streams read from it in parallel, see CopyFrom
+func (s *WriterSocket) ReadFrom(r io.Reader) (int64, error) {
+	if source, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		offset, err := source.Seek(0, io.SeekCurrent)
+		if err == nil {
+			var end int64
+			end, err = source.Seek(0, io.SeekEnd)
+			if err == nil {
+				return s.CopyFrom(source, offset, end-offset)
+			}
+		}
+	}
+
+	// Hide ReadFrom, io.Copy would call it again
+	return io.Copy(struct{ io.Writer }{s}, r)
+}
+
 func (s *WriterSocket) dispatchWriter() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Throughput and round trip times are measured from
+	// acknowledgements, without them segments of the length
+	// given to NewWriterSocket are sent over whichever
+	// stream is ready, i.e. in turns if all are equally fast
+	if !s.acknowledge && (s.scheduler != nil || s.adaptive != nil) {
+		log.Info("Segments are not acknowledged, not adapting to the streams")
+		s.scheduler = nil
+		s.adaptive = nil
+		s.chunkLength = s.maxLength
+	}
+
 	for _, socket := range s.sockets {
-		go s.writer(socket)
+		s.addStream(socket)
+	}
+
+	if s.accept != nil {
+		go s.acceptReplacements(s.replace)
 	}
 
-	eodc := striping.NewEODCSegment(uint64(len(s.sockets)))
-	s.segmentChannel <- eodc
+	go s.adapt()
 }
 
-func (s *WriterSocket) writer(socket DataSocket) {
+// addStream starts sending on the socket. Streams that are added
+// later on replace a failed stream.
+// Has to be called while holding the lock
+func (s *WriterSocket) addStream(socket DataSocket) {
+	stream := &writeStream{socket: socket, active: true}
+	s.streams = append(s.streams, stream)
+
+	s.writers.Add(1)
+	go s.writer(stream)
+	if s.acknowledge {
+		go s.receiveAcks(stream)
+	}
+
+	s.cond.Broadcast()
+}
+
+func (s *WriterSocket) writer(stream *writeStream) {
+	defer s.writers.Done()
+
 	for {
-		select {
-		case segment := <-s.segmentChannel:
-			err := writeSegment(segment, socket)
-			if err != nil {
-				log.Error("Failed to write segment", "err", err)
+		s.mu.Lock()
+		var segment *striping.Segment
+		for !s.done && !stream.failed && s.err == nil {
+			segment = s.nextSegment(stream)
+			if segment != nil {
+				break
 			}
+			s.cond.Wait()
+		}
 
-		case <-s.child.ShouldStop():
-			eod := striping.NewHeader(
-				0, 0,
-				striping.BlockFlagEndOfData)
-			err := writeHeader(eod, socket)
-			if err != nil {
-				log.Error("Failed to write eod header", "err", err)
+		if s.done || stream.failed || s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		stream.writing = true
+		stream.lastSent = time.Now()
+		if s.acknowledge {
+			stream.inflight = append(stream.inflight, sentSegment{segment, stream.lastSent})
+			stream.unacknowledged += int(segment.ByteCount)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		data, err := s.read(segment)
+		if err != nil {
+			log.Error("Failed to read segment", "err", err)
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = err
 			}
-			s.child.Done()
+			stream.writing = false
+			s.cond.Broadcast()
+			s.mu.Unlock()
 			return
 		}
+
+		err = writeSegment(data, stream.socket, s.checksums)
+
+		// Waiting streams might be scheduled differently now
+		s.mu.Lock()
+		stream.writing = false
+		if err == nil {
+			stream.transferred += segment.ByteCount
+		}
+		if !s.acknowledge && err == nil {
+			// The throughput can only be measured
+			// by how fast the socket takes the data
+			stream.ackedBytes += int(segment.ByteCount)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Error("Failed to write segment", "err", err)
+			s.fail(stream)
+			return
+		}
+	}
+}
+
+// read returns the segment with its data, which is read from
+// the source set by CopyRanges if the segment doesn't have any.
+// The segment itself stays without data, in case it has to be
+// sent again or another stream sends a copy of it
+func (s *WriterSocket) read(segment *striping.Segment) (*striping.Segment, error) {
+	if segment.Data != nil || segment.ByteCount == 0 {
+		return segment, nil
+	}
+
+	data := make([]byte, segment.ByteCount)
+	n, err := s.source.ReadAt(data, s.sourceBase+int64(segment.OffsetCount))
+	if n == len(data) {
+		err = nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return striping.NewSegmentWithHeader(segment.Header, data), nil
 }
 
-// Closing the WriterSocket blocks until until all
-// children have finished senidng and then sends the
-// closing connection header over all sub-sockets
-// to signal closing the connection
+// receiveAcks reads the number of segments the receiver got
+// over the stream, these segments don't need to be resent
+func (s *WriterSocket) receiveAcks(stream *writeStream) {
+	var acked uint64
+
+	for {
+		var count uint64
+		err := binary.Read(stream.socket, binary.BigEndian, &count)
+		if err != nil {
+			s.mu.Lock()
+			done := s.done
+			s.mu.Unlock()
+
+			if !done {
+				log.Error("Failed to receive acknowledgement", "err", err)
+				s.fail(stream)
+			}
+			return
+		}
+
+		// Counts only grow, anything else isn't an acknowledgement
+		if count < acked {
+			log.Error("Received invalid acknowledgement", "count", count, "acked", acked)
+			s.fail(stream)
+			return
+		}
+
+		s.mu.Lock()
+		n := int(count - acked)
+		if n > len(stream.inflight) {
+			n = len(stream.inflight)
+		}
+		now := time.Now()
+		for _, sent := range stream.inflight[:n] {
+			stream.ackedBytes += int(sent.ByteCount)
+			stream.unacknowledged -= int(sent.ByteCount)
+			if rtt := now.Sub(sent.sentAt); stream.minRTT == 0 || rtt < stream.minRTT {
+				stream.minRTT = rtt
+			}
+		}
+		stream.inflight = stream.inflight[n:]
+		acked = count
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// fail stops using the stream and sends its unacknowledged
+// segments again over the remaining streams
+func (s *WriterSocket) fail(stream *writeStream) {
+	s.mu.Lock()
+	if stream.failed {
+		s.mu.Unlock()
+		return
+	}
+
+	stream.failed = true
+	redial := !s.done && s.redial != nil && s.acknowledge
+
+	// Without acknowledgements, it is unknown which segments
+	// the receiver got, so the transfer can't continue
+	if !s.done && !s.acknowledge && s.err == nil {
+		s.err = fmt.Errorf("data stream failed")
+	}
+
+	if !s.done {
+		var resend []*striping.Segment
+		for _, sent := range stream.inflight {
+			resend = append(resend, sent.Segment)
+		}
+		s.pending = append(resend, s.pending...)
+		stream.inflight = nil
+		stream.redundant = nil
+		stream.unacknowledged = 0
+		s.lastFailure = time.Now()
+		s.wakeAfterTimeout()
+	}
+
+	if redial {
+		s.redialing++
+	}
+
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	stream.socket.Close()
+
+	if redial {
+		go func() {
+			socket, err := s.redial()
+
+			s.mu.Lock()
+			s.redialing--
+			s.cond.Broadcast()
+			s.mu.Unlock()
+
+			if err != nil {
+				log.Error("Failed to replace data stream", "err", err)
+				return
+			}
+
+			s.replace(socket)
+		}()
+	}
+}
+
+// replace adds a new stream, unless all data has been sent already
+func (s *WriterSocket) replace(socket DataSocket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		socket.Close()
+		return
+	}
+
+	s.addStream(socket)
+}
+
+// Wakes up waiting writes once a replacement stream
+// can no longer be expected
+func (s *WriterSocket) wakeAfterTimeout() {
+	time.AfterFunc(ReplacementTimeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+// Transferred returns the number of bytes sent over each stream,
+// including the ones that replaced failed streams, in the order
+// the streams were added
+func (s *WriterSocket) Transferred() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transferred := make([]uint64, len(s.streams))
+	for i, stream := range s.streams {
+		transferred[i] = stream.transferred
+	}
+
+	return transferred
+}
+
+// Has to be called while holding the lock
+func (s *WriterSocket) live() int {
+	live := 0
+	for _, stream := range s.streams {
+		if !stream.failed {
+			live++
+		}
+	}
+	return live
+}
+
+// unavailable reports whether there is no stream left to send
+// data and none is going to be replaced.
+// Has to be called while holding the lock
+func (s *WriterSocket) unavailable() bool {
+	if s.live() > 0 || s.redialing > 0 {
+		return false
+	}
+
+	return s.accept == nil || time.Since(s.lastFailure) >= ReplacementTimeout
+}
+
+// Has to be called while holding the lock
+func (s *WriterSocket) acknowledged() bool {
+	if len(s.pending) > 0 || len(s.sourceRanges) > 0 {
+		return false
+	}
+
+	for _, stream := range s.streams {
+		if !stream.failed && (len(stream.inflight) > 0 || stream.writing) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Closing the WriterSocket blocks until all segments have been sent, or
+// acknowledged if the receiver does so. Then each remaining sub-socket
+// sends the end of data (EOD) and closes. One of them also sends the
+// number of sub-sockets that do so (EOD count), as in GridFTP
 func (s *WriterSocket) Close() error {
 
+	// Nothing has been written, but the receiver
+	// still expects the end of data
+	if !s.dispatched {
+		s.dispatched = true
+		s.dispatchWriter()
+	}
+
+	var err error
+
+	s.mu.Lock()
+	for (!s.acknowledged() || s.redialing > 0) && s.err == nil {
+		if s.unavailable() {
+			err = fmt.Errorf("all data streams failed")
+			break
+		}
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		err = s.err
+	}
+	aborted := s.err != nil
+	s.done = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.stopAccepting()
+
 	// Wait until all sockets finished sending
-	s.parent.Wait()
+	s.writers.Wait()
+
+	s.mu.Lock()
+	var remaining []*writeStream
+	for _, stream := range s.streams {
+		if !stream.failed {
+			remaining = append(remaining, stream)
+		}
+	}
+	s.mu.Unlock()
+
+	for i, stream := range remaining {
 
-	for i, subSocket := range s.sockets {
-		closingHeader := striping.NewClosingHeader()
-		err := writeHeader(closingHeader, subSocket)
+		// The receiver must not take the
+		// data it got for complete
+		if aborted {
+			stream.socket.Close()
+			continue
+		}
+
+		flags := []uint8{striping.BlockFlagEndOfData, striping.BlockFlagSenderClosesConnection}
+		eod := striping.NewHeader(0, 0, flags...)
+		if i == 0 {
+			eod = striping.NewEODCHeader(uint64(len(remaining)), flags...)
+		}
+
+		err := writeHeader(eod, stream.socket)
 		if err != nil {
-			log.Debug("Failed to write header", "err", err)
+			log.Error("Failed to write eod header", "err", err)
 		}
-		s.sockets[i] = nil
+		stream.socket.Close()
 	}
 
-	return nil
+	return err
 }
 
 // Helper Functions
@@ -121,16 +607,23 @@ func writeHeader(header *striping.Header, socket DataSocket) error {
 	return binary.Write(socket, binary.BigEndian, header)
 }
 
-func writeSegment(segment *striping.Segment, socket DataSocket) error {
+func writeSegment(segment *striping.Segment, socket DataSocket, checksums bool) error {
 	err := writeHeader(segment.Header, socket)
 	if err != nil {
 		return err
 	}
 
-	if segment.IsEODCount() {
+	if segment.IsEODCount() || segment.ByteCount == 0 {
 		return nil
 	}
 
+	if checksums {
+		err = binary.Write(socket, binary.BigEndian, segment.Checksum())
+		if err != nil {
+			return err
+		}
+	}
+
 	cur := 0
 
 	for {
@@ -2,21 +2,25 @@ package striping
 
 // Extended Block Header Flags
 const (
+	// Called EOF in GFD.020, the offset of the header is the number
+	// of streams that send the end of data (EOD count)
 	BlockFlagEndOfDataCount         uint8 = 64
-	BlockFlagSuspectErrors          uint8 = 32
+	BlockFlagSuspectErrors          uint8 = 32 // The data is likely corrupted, see Segment.Checksum
 	BlockFlagEndOfData              uint8 = 8
 	BlockFlagSenderClosesConnection uint8 = 4
 
 	// Deprecated: Around for legacy purposes
 	BlockFlagEndOfRecord uint8 = 128
-	// Deprecated: Around for legacy purposes
+	// Deprecated: Restart markers are sent over the
+	// control channel instead, see Ranges
 	BlockFlagRestartMarker uint8 = 16
 )
 
 // The header is sent over the data channels and indicates
 // information about the following data (if any)
 // See https://www.ogf.org/documents/GWD-R/GFD-R.020.pdf
-// section "Extended Block Mode"
+// section "Extended Block Mode". The framing follows the specification,
+// it has not been tested against other implementations such as Globus
 type Header struct {
 	Descriptor  uint8
 	ByteCount   uint64
@@ -0,0 +1,152 @@
+package striping
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Range is a part of the data, from Start up to but not including End
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+// Ranges is a sorted list of ranges that neither overlap nor touch.
+// GridFTP uses it in restart markers and in REST to describe the parts
+// of a file that have been transferred in Extended Block mode
+type Ranges []Range
+
+// ParseRanges parses a comma separated list of ranges,
+// e.g. "0-1000,2000-3000", as sent in restart markers
+func ParseRanges(s string) (Ranges, error) {
+	var ranges Ranges
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ranges, nil
+	}
+
+	for _, field := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(field), "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid range %q", field)
+		}
+
+		start, err := strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %s", field, err)
+		}
+
+		end, err := strconv.ParseUint(bounds[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %s", field, err)
+		}
+
+		if end < start {
+			return nil, fmt.Errorf("invalid range %q: end before start", field)
+		}
+
+		ranges = ranges.Add(start, end)
+	}
+
+	return ranges, nil
+}
+
+func (ranges Ranges) String() string {
+	fields := make([]string, len(ranges))
+	for i, r := range ranges {
+		fields[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// Add returns the ranges including start up to end, merged
+// with the ranges it overlaps or touches
+func (ranges Ranges) Add(start, end uint64) Ranges {
+	if start >= end {
+		return ranges
+	}
+
+	result := make(Ranges, 0, len(ranges)+1)
+	inserted := false
+	for _, r := range ranges {
+		switch {
+		case r.End < start:
+			result = append(result, r)
+		case r.Start > end:
+			if !inserted {
+				result = append(result, Range{start, end})
+				inserted = true
+			}
+			result = append(result, r)
+		default:
+			if r.Start < start {
+				start = r.Start
+			}
+			if r.End > end {
+				end = r.End
+			}
+		}
+	}
+
+	if !inserted {
+		result = append(result, Range{start, end})
+	}
+
+	return result
+}
+
+// Contains reports whether start up to end is covered completely
+func (ranges Ranges) Contains(start, end uint64) bool {
+	if start >= end {
+		return true
+	}
+
+	for _, r := range ranges {
+		if r.Start <= start && end <= r.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing returns the parts of start up to end that are not covered
+func (ranges Ranges) Missing(start, end uint64) Ranges {
+	var missing Ranges
+
+	for _, r := range ranges {
+		if start >= end {
+			break
+		}
+		if r.End <= start {
+			continue
+		}
+		if r.Start >= end {
+			break
+		}
+
+		if r.Start > start {
+			missing = append(missing, Range{start, r.Start})
+		}
+		start = r.End
+	}
+
+	if start < end {
+		missing = append(missing, Range{start, end})
+	}
+
+	return missing
+}
+
+// Size returns the number of bytes covered
+func (ranges Ranges) Size() uint64 {
+	var size uint64
+	for _, r := range ranges {
+		size += r.End - r.Start
+	}
+
+	return size
+}
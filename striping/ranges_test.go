@@ -0,0 +1,61 @@
+package striping
+
+import "testing"
+
+func TestRanges(t *testing.T) {
+	tests := []struct {
+		ranges  string
+		add     Range
+		want    string
+		missing string // Within 0-100
+	}{
+		{"", Range{10, 20}, "10-20", "0-10,20-100"},
+		{"10-20", Range{30, 40}, "10-20,30-40", "0-10,20-30,40-100"},
+		{"30-40", Range{10, 20}, "10-20,30-40", "0-10,20-30,40-100"},
+		{"10-20,30-40", Range{15, 35}, "10-40", "0-10,40-100"},
+		{"10-20,30-40", Range{20, 30}, "10-40", "0-10,40-100"},
+		{"10-20,30-40", Range{0, 100}, "0-100", ""},
+		{"10-20", Range{12, 18}, "10-20", "0-10,20-100"},
+		{"10-20", Range{20, 20}, "10-20", "0-10,20-100"},
+		{"90-120", Range{0, 10}, "0-10,90-120", "10-90"},
+	}
+
+	for _, test := range tests {
+		ranges, err := ParseRanges(test.ranges)
+		if err != nil {
+			t.Fatalf("%q: %s", test.ranges, err)
+		}
+
+		ranges = ranges.Add(test.add.Start, test.add.End)
+		if got := ranges.String(); got != test.want {
+			t.Errorf("%q + %v: got %q, want %q", test.ranges, test.add, got, test.want)
+		}
+
+		if got := ranges.Missing(0, 100).String(); got != test.missing {
+			t.Errorf("%q missing: got %q, want %q", test.want, got, test.missing)
+		}
+
+		if !ranges.Contains(test.add.Start, test.add.End) {
+			t.Errorf("%q does not contain %v", test.want, test.add)
+		}
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	ranges, err := ParseRanges("200-300, 0-100,100-150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ranges.String(); got != "0-150,200-300" {
+		t.Errorf("got %q, want %q", got, "0-150,200-300")
+	}
+	if ranges.Size() != 250 {
+		t.Errorf("size: got %d, want 250", ranges.Size())
+	}
+
+	for _, invalid := range []string{"100", "a-b", "10-5", "0-10,"} {
+		if _, err := ParseRanges(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package striping
 
-import "github.com/elwin/transmit/queue"
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/elwin/transmit/queue"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
 
 type Segment struct {
 	*Header
@@ -30,3 +37,15 @@ func NewSegmentWithHeader(header *Header, data []byte) *Segment {
 		data,
 	}
 }
+
+// Checksum returns the CRC32C checksum of the header, as it is sent, and
+// the data. If both ends agreed on checksums, it follows the header of each
+// segment that carries data, which GridFTP doesn't know about
+func (a *Segment) Checksum() uint32 {
+	header := make([]byte, 17)
+	header[0] = a.Descriptor
+	binary.BigEndian.PutUint64(header[1:], a.ByteCount)
+	binary.BigEndian.PutUint64(header[9:], a.OffsetCount)
+
+	return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, a.Data)
+}
@@ -0,0 +1,25 @@
+package striping
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	segment := NewSegment([]byte("hello world"), 1000)
+	checksum := segment.Checksum()
+
+	// Flipping a bit anywhere in the header or the data changes it
+	flips := map[string]func(*Segment){
+		"descriptor": func(s *Segment) { s.Descriptor ^= 1 },
+		"byte count": func(s *Segment) { s.ByteCount ^= 1 },
+		"offset":     func(s *Segment) { s.OffsetCount ^= 1 << 20 },
+		"data":       func(s *Segment) { s.Data[0] ^= 1 },
+	}
+
+	for field, flip := range flips {
+		corrupted := NewSegment([]byte("hello world"), 1000)
+		flip(corrupted)
+
+		if corrupted.Checksum() == checksum {
+			t.Errorf("%s: expected the checksum to change", field)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elwin/transmit/scion"
+)
+
+var _ Transport = &Memory{}
+
+// Memory connects listeners and dialers within the same process,
+// similar to net.Pipe. Each Memory instance is its own network,
+// so independent tests don't interfere with each other
+type Memory struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		listeners: make(map[string]*memoryListener),
+		nextPort:  50000,
+	}
+}
+
+// Listen announces on the given address, port 0 picks
+// an unused port
+func (m *Memory) Listen(address string) (scion.Listener, error) {
+	host, port, err := SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if port == 0 {
+		port = m.allocatePort()
+	}
+
+	address = JoinHostPort(host, port)
+	if _, exists := m.listeners[address]; exists {
+		return nil, fmt.Errorf("unable to listen on %s: address already in use", address)
+	}
+
+	listener := &memoryListener{
+		memory:  m,
+		addr:    memoryAddr(address),
+		pending: make(chan scion.Conn, memoryBacklog),
+		closed:  make(chan struct{}),
+	}
+	m.listeners[address] = listener
+
+	return listener, nil
+}
+
+// Dial connects to a listener of the same Memory instance
+func (m *Memory) Dial(local, remote string) (scion.Conn, error) {
+	host, port, err := SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	remote = JoinHostPort(host, port)
+
+	m.mu.Lock()
+	listener, ok := m.listeners[remote]
+	localAddr := memoryAddr(JoinHostPort(local, m.allocatePort()))
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unable to dial %s: connection refused", remote)
+	}
+
+	client, server := newMemoryPipe(localAddr, memoryAddr(remote))
+
+	select {
+	case listener.pending <- server:
+		return client, nil
+	case <-listener.closed:
+		return nil, fmt.Errorf("unable to dial %s: connection refused", remote)
+	}
+}
+
+// allocatePort picks an unused port from the dynamic range, as real
+// networks do. IPv4 stripes can't express larger ports, see JoinStripe.
+// Has to be called while holding the lock
+func (m *Memory) allocatePort() int {
+	for {
+		m.nextPort++
+		if m.nextPort > 65535 {
+			m.nextPort = 49152
+		}
+
+		if !m.inUse(m.nextPort) {
+			return m.nextPort
+		}
+	}
+}
+
+// inUse reports whether any host listens on the port.
+// Has to be called while holding the lock
+func (m *Memory) inUse(port int) bool {
+	for address := range m.listeners {
+		if _, p, _ := SplitHostPort(address); p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Number of connections that may wait to be accepted
+const memoryBacklog = 16
+
+var _ scion.Listener = &memoryListener{}
+
+type memoryListener struct {
+	memory    *Memory
+	addr      memoryAddr
+	pending   chan scion.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *memoryListener) Addr() net.Addr {
+	return listener.addr
+}
+
+func (listener *memoryListener) Accept() (scion.Conn, error) {
+	select {
+	case conn := <-listener.pending:
+		return conn, nil
+	case <-listener.closed:
+		return nil, fmt.Errorf("unable to accept on %s: listener closed", listener.addr)
+	}
+}
+
+func (listener *memoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		listener.memory.mu.Lock()
+		delete(listener.memory.listeners, string(listener.addr))
+		listener.memory.mu.Unlock()
+
+		close(listener.closed)
+
+		// Refuse connections that have not been accepted yet
+		for {
+			select {
+			case conn := <-listener.pending:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+type memoryAddr string
+
+func (memoryAddr) Network() string {
+	return "memory"
+}
+
+func (addr memoryAddr) String() string {
+	return string(addr)
+}
+
+// newMemoryPipe returns both ends of a connection. Contrary to
+// net.Pipe writes are buffered and never block, so that both
+// ends can write at the same time without deadlocking
+func newMemoryPipe(local, remote memoryAddr) (*memoryConn, *memoryConn) {
+	a, b := newMemoryBuffer(), newMemoryBuffer()
+
+	return &memoryConn{a, b, local, remote},
+		&memoryConn{b, a, remote, local}
+}
+
+var _ scion.Conn = &memoryConn{}
+
+type memoryConn struct {
+	in     *memoryBuffer
+	out    *memoryBuffer
+	local  memoryAddr
+	remote memoryAddr
+}
+
+func (conn *memoryConn) Read(b []byte) (n int, err error) {
+	return conn.in.Read(b)
+}
+
+func (conn *memoryConn) Write(b []byte) (n int, err error) {
+	return conn.out.Write(b)
+}
+
+// Close closes both directions, the remote end can still
+// read whatever has been written before
+func (conn *memoryConn) Close() error {
+	conn.out.closeWrite()
+	conn.in.closeRead()
+	return nil
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *memoryConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *memoryConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *memoryConn) SetReadDeadline(t time.Time) error {
+	conn.in.setDeadline(t)
+	return nil
+}
+
+// Writes never block, hence there is no need for a deadline
+func (conn *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// memoryBuffer is one direction of a memoryConn
+type memoryBuffer struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	buf         bytes.Buffer
+	writeClosed bool
+	readClosed  bool
+	deadline    time.Time
+	timer       *time.Timer
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memoryBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if b.readClosed {
+			return 0, io.ErrClosedPipe
+		}
+
+		if b.buf.Len() > 0 {
+			return b.buf.Read(p)
+		}
+
+		if b.writeClosed {
+			return 0, io.EOF
+		}
+
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, timeoutError{}
+		}
+
+		b.cond.Wait()
+	}
+}
+
+func (b *memoryBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeClosed || b.readClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := b.buf.Write(p)
+	b.cond.Broadcast()
+
+	return n, err
+}
+
+func (b *memoryBuffer) closeWrite() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.writeClosed = true
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) closeRead() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readClosed = true
+	b.buf.Reset()
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	// Wake up blocked readers once the deadline has passed
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+
+	b.cond.Broadcast()
+}
+
+var _ net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "i/o timeout"
+}
+
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+func (timeoutError) Temporary() bool {
+	return true
+}
@@ -0,0 +1,38 @@
+package transport
+
+import "github.com/elwin/transmit/scion"
+
+var _ Transport = Scion{}
+
+// Scion sends all connections as QUIC streams over SCION.
+// It requires a running sciond and dispatcher
+type Scion struct {
+	// Policy selects the paths of outgoing connections,
+	// optional, defaults to the shortest path
+	Policy scion.PathPolicy
+}
+
+func (Scion) Listen(address string) (scion.Listener, error) {
+	return scion.Listen(address)
+}
+
+func (t Scion) Dial(local, remote string) (scion.Conn, error) {
+	return scion.DialAddr(local, remote, t.Policy)
+}
+
+var _ Multipath = Scion{}
+
+func (t Scion) DialMultipath(local string, remotes []string) ([]scion.Conn, error) {
+	return scion.DialMultipathAddr(local, remotes, t.Policy)
+}
+
+func (t Scion) DialReplacement(local, remote string, n int) (scion.Conn, error) {
+	return scion.DialReplacementAddr(local, remote, t.Policy, n)
+}
+
+var _ PathSelector = Scion{}
+
+func (t Scion) WithPathPolicy(policy scion.PathPolicy) Transport {
+	t.Policy = policy
+	return t
+}
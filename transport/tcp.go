@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/elwin/transmit/scion"
+)
+
+var _ Transport = TCP{}
+
+// TCP uses plain TCP connections and does not depend on
+// a SCION stack, the host part of an address is an IP
+// address or hostname
+type TCP struct{}
+
+func (TCP) Listen(address string) (scion.Listener, error) {
+	host, port, err := SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpListener{listener}, nil
+}
+
+func (TCP) Dial(local, remote string) (scion.Conn, error) {
+	host, port, err := SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{}
+	if ip := net.ParseIP(local); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return dialer.Dial("tcp", JoinHostPort(host, port))
+}
+
+var _ scion.Listener = &tcpListener{}
+
+type tcpListener struct {
+	net.Listener
+}
+
+func (listener *tcpListener) Accept() (scion.Conn, error) {
+	return listener.Listener.Accept()
+}
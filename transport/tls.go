@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/elwin/transmit/scion"
+)
+
+var _ scion.Conn = &TLSConn{}
+
+// TLSConn is a connection secured with TLS, see TLSClient and TLSServer
+type TLSConn struct {
+	*tls.Conn
+}
+
+// TLSClient secures conn with TLS, taking the role of the client
+func TLSClient(conn scion.Conn, config *tls.Config) *TLSConn {
+	return &TLSConn{tls.Client(conn, config)}
+}
+
+// TLSServer secures conn with TLS, taking the role of the server
+func TLSServer(conn scion.Conn, config *tls.Config) *TLSConn {
+	return &TLSConn{tls.Server(conn, config)}
+}
+
+// Close closes the connection. Contrary to tls.Conn it doesn't fail if
+// the close notification can't be sent because the peer closed the
+// connection already, as FTP servers do after each transfer
+func (conn *TLSConn) Close() error {
+	err := conn.Conn.Close()
+	if err != nil && peerClosed(err) {
+		return nil
+	}
+
+	return err
+}
+
+// peerClosed reports whether err stems from writing
+// to a connection that the peer closed already
+func peerClosed(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+
+	if err == io.EOF || err == io.ErrClosedPipe {
+		return true
+	}
+
+	// Wrapped, e.g. by newer versions of tls.Conn.Close
+	msg := err.Error()
+	return strings.HasSuffix(msg, io.EOF.Error()) ||
+		strings.Contains(msg, io.ErrClosedPipe.Error()) ||
+		strings.Contains(msg, "use of closed") ||
+		strings.Contains(msg, "broken pipe")
+}
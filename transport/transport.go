@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/elwin/transmit/scion"
+)
+
+// Transport opens the control and data connections used by
+// the server and the client. Addresses are passed in the
+// form host:port, where host is whatever the transport
+// understands (e.g. "1-ff00:0:110,[127.0.0.1]" for SCION)
+type Transport interface {
+	// Listen announces on the given address
+	Listen(address string) (scion.Listener, error)
+
+	// Dial connects from the local host to the remote address
+	Dial(local, remote string) (scion.Conn, error)
+}
+
+// Lookup returns the transport with the given name,
+// either "scion" or "tcp"
+func Lookup(name string) (Transport, error) {
+	switch strings.ToLower(name) {
+	case "scion":
+		return Scion{}, nil
+	case "tcp":
+		return TCP{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %s", name)
+	}
+}
+
+// SplitHostPort splits an address of the form host:port.
+// Contrary to net.SplitHostPort it accepts SCION addresses,
+// which contain colons in the host part as well
+func SplitHostPort(address string) (host string, port int, err error) {
+	i := strings.LastIndex(address, ":")
+	if i == -1 {
+		return "", 0, fmt.Errorf("missing port in address %s", address)
+	}
+
+	port, err = strconv.Atoi(address[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in address %s", address)
+	}
+
+	host = address[:i]
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	return host, port, nil
+}
+
+// JoinHostPort is the inverse of SplitHostPort
+func JoinHostPort(host string, port int) string {
+	if strings.Contains(host, ":") && !strings.HasSuffix(host, "]") {
+		// Bare IPv6 address
+		host = "[" + host + "]"
+	}
+
+	return host + ":" + strconv.Itoa(port)
+}
+
+// JoinStripe formats the address of a stripe as listed in the reply to SPAS
+// and passed to SPOR. IPv4 addresses take the GridFTP form h1,h2,h3,h4,p1,p2,
+// which GridFTP clients and servers expect. Other hosts, such as SCION
+// addresses, take the form host:port, see JoinHostPort
+func JoinStripe(host string, port int) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		ip = ip.To4()
+		return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	}
+
+	return JoinHostPort(host, port)
+}
+
+// SplitStripe is the inverse of JoinStripe
+func SplitStripe(stripe string) (host string, port int, err error) {
+	if strings.Contains(stripe, ":") {
+		return SplitHostPort(stripe)
+	}
+
+	nums := strings.Split(stripe, ",")
+	if len(nums) != 6 {
+		return "", 0, fmt.Errorf("invalid stripe %s", stripe)
+	}
+
+	var values [6]int
+	for i, num := range nums {
+		values[i], err = strconv.Atoi(num)
+		if err != nil || values[i] < 0 || values[i] > 255 {
+			return "", 0, fmt.Errorf("invalid stripe %s", stripe)
+		}
+	}
+
+	host = fmt.Sprintf("%d.%d.%d.%d", values[0], values[1], values[2], values[3])
+	return host, values[4]<<8 | values[5], nil
+}
+
+// HostName returns the host of a SCION host such as
+// "1-ff00:0:110,[10.0.0.1]" without the ISD-AS and brackets,
+// i.e. "10.0.0.1". Hosts of other transports are returned as is
+func HostName(host string) string {
+	if i := strings.Index(host, ","); i != -1 {
+		host = host[i+1:]
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Multipath is implemented by transports that can spread
+// several connections over distinct network paths
+type Multipath interface {
+	// DialMultipath opens a connection to each of the remotes,
+	// using as many distinct paths as possible
+	DialMultipath(local string, remotes []string) ([]scion.Conn, error)
+
+	// DialReplacement connects to remote as the n-th connection,
+	// counting from zero, over the path DialMultipath would assign
+	// to it. This replaces failed connections over other paths
+	DialReplacement(local, remote string, n int) (scion.Conn, error)
+}
+
+// PathSelector is implemented by transports that select
+// the network paths of the connections they dial
+type PathSelector interface {
+	// WithPathPolicy returns a copy of the transport
+	// that selects paths according to the policy
+	WithPathPolicy(policy scion.PathPolicy) Transport
+}
+
+// WithPathPolicy returns a copy of t that selects paths according to
+// the policy, given that t is a PathSelector. Otherwise t is returned
+// unchanged. The policy only applies to the connections t dials, those
+// it accepts take the path chosen by the remote
+func WithPathPolicy(t Transport, policy scion.PathPolicy) Transport {
+	if policy == nil {
+		return t
+	}
+
+	if selector, ok := t.(PathSelector); ok {
+		return selector.WithPathPolicy(policy)
+	}
+
+	return t
+}
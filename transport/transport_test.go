@@ -0,0 +1,194 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/elwin/transmit/scion"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	var tests = []struct {
+		address string
+		host    string
+		port    int
+	}{
+		{"1-ff00:0:110,[127.0.0.1]:2121", "1-ff00:0:110,[127.0.0.1]", 2121},
+		{"1-ff00:0:110,[::1]:40000", "1-ff00:0:110,[::1]", 40000},
+		{"127.0.0.1:2121", "127.0.0.1", 2121},
+		{"[::1]:2121", "::1", 2121},
+		{"localhost:21", "localhost", 21},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			host, port, err := SplitHostPort(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("got %q %d, want %q %d", host, port, tt.host, tt.port)
+			}
+			if address := JoinHostPort(host, port); address != tt.address {
+				t.Errorf("JoinHostPort: got %q, want %q", address, tt.address)
+			}
+		})
+	}
+
+	for _, address := range []string{"1-ff00:0:110,[127.0.0.1]", "localhost", "localhost:ftp"} {
+		if _, _, err := SplitHostPort(address); err == nil {
+			t.Errorf("SplitHostPort(%q): expected error", address)
+		}
+	}
+}
+
+func TestSplitStripe(t *testing.T) {
+	var tests = []struct {
+		stripe string
+		host   string
+		port   int
+	}{
+		{"127,0,0,1,156,64", "127.0.0.1", 40000},
+		{"10,1,2,3,0,21", "10.1.2.3", 21},
+		{"1-ff00:0:110,[127.0.0.1]:40000", "1-ff00:0:110,[127.0.0.1]", 40000},
+		{"[::1]:40000", "::1", 40000},
+		{"server:40000", "server", 40000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stripe, func(t *testing.T) {
+			host, port, err := SplitStripe(tt.stripe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("got %q %d, want %q %d", host, port, tt.host, tt.port)
+			}
+			if stripe := JoinStripe(host, port); stripe != tt.stripe {
+				t.Errorf("JoinStripe: got %q, want %q", stripe, tt.stripe)
+			}
+		})
+	}
+
+	for _, stripe := range []string{"127,0,0,1,156", "127,0,0,256,156,64", "127,0,0,1,a,64", "server"} {
+		if _, _, err := SplitStripe(stripe); err == nil {
+			t.Errorf("SplitStripe(%q): expected error", stripe)
+		}
+	}
+}
+
+func TestHostName(t *testing.T) {
+	var tests = []struct {
+		host string
+		name string
+	}{
+		{"1-ff00:0:110,[127.0.0.1]", "127.0.0.1"},
+		{"1-ff00:0:110,[::1]", "::1"},
+		{"1-ff00:0:110,127.0.0.1", "127.0.0.1"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "::1"},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		if name := HostName(tt.host); name != tt.name {
+			t.Errorf("HostName(%q): got %q, want %q", tt.host, name, tt.name)
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := TCP{}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("Hello World"))
+		conn.Close()
+	}()
+
+	conn, err := TCP{}.Dial("127.0.0.1", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "Hello World" {
+		t.Errorf("got %q", buf)
+	}
+}
+
+func TestMemoryPorts(t *testing.T) {
+	m := NewMemory()
+	m.nextPort = 65534
+
+	// Wraps around to the start of the dynamic range,
+	// skipping the ports that are in use
+	if _, err := m.Listen("server:49152"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{65535, 49153} {
+		listener, err := m.Listen("server:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, port, _ := SplitHostPort(listener.Addr().String()); port != want {
+			t.Errorf("got port %d, want %d", port, want)
+		}
+	}
+}
+
+func TestPeerClosed(t *testing.T) {
+	var tests = []struct {
+		err    error
+		closed bool
+	}{
+		{io.EOF, true},
+		{&net.OpError{Op: "write", Err: io.ErrClosedPipe}, true},
+		{errors.New("use of closed network connection"), true},
+		{errors.New("write: broken pipe"), true},
+		{errors.New("tls: failed to send closeNotify alert (but connection was closed anyway): io: read/write on closed pipe"), true},
+		{errors.New("tls: failed to send closeNotify alert"), false},
+		{&net.OpError{Op: "write", Err: errors.New("i/o timeout")}, false},
+	}
+
+	for _, tt := range tests {
+		if closed := peerClosed(tt.err); closed != tt.closed {
+			t.Errorf("%v: got %t, want %t", tt.err, closed, tt.closed)
+		}
+	}
+}
+
+func TestWithPathPolicy(t *testing.T) {
+	policy := scion.ShortestPath()
+
+	for _, tr := range []Transport{Scion{}, &Scion{}} {
+		selected, ok := WithPathPolicy(tr, policy).(Scion)
+		if !ok || selected.Policy == nil {
+			t.Errorf("%T: policy not set", tr)
+		}
+	}
+
+	if tr := WithPathPolicy(TCP{}, policy); tr != (TCP{}) {
+		t.Errorf("TCP: got %T", tr)
+	}
+	if tr := WithPathPolicy(Scion{}, nil); tr.(Scion).Policy != nil {
+		t.Errorf("nil policy: policy set")
+	}
+}